@@ -7,9 +7,15 @@ package main
 import (
 	. "container/vector"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -44,20 +50,250 @@ func ReadConfig(filename string) (map[string]string, os.Error) {
 	return config, err
 }
 
+// the character naming the compiler, linker and object files of each
+// architecture
+var archChars = map[string]string{
+	"386":   "8",
+	"amd64": "6",
+	"arm":   "5",
+}
+
+// the operating systems which may appear in file name suffixes
+var knownOS = map[string]bool{
+	"darwin":  true,
+	"freebsd": true,
+	"linux":   true,
+	"openbsd": true,
+	"plan9":   true,
+	"windows": true,
+}
+
+// the target to find files for; if empty, files are not filtered
+var targetOS, targetArch string
+
+// MatchesTarget reports whether a file, by the _GOOS, _GOARCH or
+// _GOOS_GOARCH suffix of its name, is built for the target.
+func MatchesTarget(fname string) bool {
+	if targetOS == "" {
+		return true
+	}
+	goos, goarch := FileTarget(fname)
+	return (goos == "" || goos == targetOS) &&
+		(goarch == "" || goarch == targetArch)
+}
+
+// FileTarget returns the operating system and architecture a file is built
+// for, by the _GOOS, _GOARCH or _GOOS_GOARCH suffix of its name; either is
+// empty if the file is built for all.
+func FileTarget(fname string) (goos, goarch string) {
+	name := path.Base(fname)
+	name = name[:len(name)-len(path.Ext(name))]
+	if strings.HasSuffix(name, "_test") {
+		name = name[:len(name)-len("_test")]
+	}
+	parts := strings.Split(name, "_", -1)
+	n := len(parts)
+	if n >= 3 && knownOS[parts[n-2]] && archChars[parts[n-1]] != "" {
+		return parts[n-2], parts[n-1]
+	}
+	if n >= 2 && knownOS[parts[n-1]] {
+		return parts[n-1], ""
+	}
+	if n >= 2 && archChars[parts[n-1]] != "" {
+		return "", parts[n-1]
+	}
+	return "", ""
+}
+
 var files = StringVector{}
 
+// whether GoFileFinder skips hidden files and directories, as godep does by
+// default
+var skipDotFiles = false
+
+// IsHidden reports whether the file or directory name starts with a '.'.
+func IsHidden(fpath string) bool {
+	name := path.Base(fpath)
+	return name != "." && name != ".." && strings.HasPrefix(name, ".")
+}
+
 type GoFileFinder struct{}
 
-func (f GoFileFinder) VisitDir(path string, finfo *os.FileInfo) bool {
-	return true
+func (f GoFileFinder) VisitDir(dpath string, finfo *os.FileInfo) bool {
+	return !skipDotFiles || !IsHidden(dpath)
 }
 
 func (f GoFileFinder) VisitFile(fpath string, finfo *os.FileInfo) {
-	if path.Ext(fpath) == ".go" {
+	if skipDotFiles && IsHidden(fpath) {
+		return
+	}
+	if path.Ext(fpath) == ".go" && MatchesTarget(fpath) {
 		files.Push(fpath)
 	}
 }
 
+// SwigInterfaces returns the SWIG interface files in dir.
+func SwigInterfaces(dir string) []string {
+	matches, _ := filepath.Glob(path.Join(dir, "*.i"))
+	return matches
+}
+
+// SwigWrapper returns the name of the go file generated by SWIG from the
+// given interface file.
+func SwigWrapper(iface string) string {
+	return iface[:len(iface)-len(".i")] + "_wrap.go"
+}
+
+// SwigModule returns the name given by the %module directive of the SWIG
+// interface file, if any.
+func SwigModule(iface string) string {
+	content, err := ioutil.ReadFile(iface)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "%module" {
+			return fields[len(fields)-1]
+		}
+	}
+	return ""
+}
+
+// ReadModulePath returns the path of the module declared in the named
+// go.mod file, or an empty string if it declares none or cannot be read.
+func ReadModulePath(fname string) string {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], "\"")
+		}
+	}
+	return ""
+}
+
+//
+// MainCheckVisitor
+//
+// Used to check for a function named 'main' (usually in a package named
+// 'main'), to decide if a file should be made into its own executable.
+//
+
+type MainCheckVisitor struct {
+	fname   string
+	hasMain bool
+}
+
+func (v *MainCheckVisitor) Visit(node ast.Node) ast.Visitor {
+	if decl, ok := node.(*ast.FuncDecl); ok {
+		if decl.Name.Name == "main" {
+			v.hasMain = true
+		}
+	}
+	return v
+}
+
+// MainFile reports whether the named file is in package main, and whether
+// it has a main function, and so is the root of an executable.
+func MainFile(fname string) (inMain, hasMain bool) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, fname, nil, 0)
+	if err != nil || file.Name.Name != "main" {
+		return false, false
+	}
+	v := &MainCheckVisitor{fname: fname}
+	ast.Walk(v, file)
+	return true, v.hasMain
+}
+
 func PrintAutoNotice() {
-	fmt.Print("# Auto-generated - DO NOT MODIFY\n")
+	FprintAutoNotice(os.Stdout)
+}
+
+func FprintAutoNotice(w io.Writer) {
+	fmt.Fprint(w, "# Auto-generated - DO NOT MODIFY\n")
+}
+
+// ShellQuote quotes a word for the shell, if it needs to be.
+func ShellQuote(word string) string {
+	if word != "" && strings.IndexAny(word, " \t\n'\"\\$`*?[]{}()<>|&;#~!") < 0 {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+// sorts packages by descending score, then by name
+type byScore struct {
+	nodes  StringVector
+	scores map[string]float64
+}
+
+func (s byScore) Len() int      { return len(s.nodes) }
+func (s byScore) Swap(i, j int) { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+func (s byScore) Less(i, j int) bool {
+	a, b := s.scores[s.nodes[i]], s.scores[s.nodes[j]]
+	if a != b {
+		return a > b
+	}
+	return s.nodes[i] < s.nodes[j]
+}
+
+// the orderings accepted by --sort-by
+var sortCriteria = map[string]bool{
+	"name":  true,
+	"size":  true,
+	"deps":  true,
+	"depth": true,
+}
+
+// SortPackages returns the packages of a graph, mapping each package to the
+// ones it imports, in the order given by criterion: by name, or by
+// descending number of files, as given by sizes, number of imports, or depth
+// in the graph.
+func SortPackages(criterion string, graph map[string][]string,
+	sizes map[string]int) StringVector {
+	nodes := StringVector{}
+	for node := range graph {
+		nodes.Push(node)
+	}
+	scores := map[string]float64{}
+	switch criterion {
+	case "size":
+		for node, size := range sizes {
+			scores[node] = float64(size)
+		}
+	case "deps":
+		for node, deps := range graph {
+			scores[node] = float64(len(deps))
+		}
+	case "depth":
+		for node := range graph {
+			GraphDepth(graph, node, scores)
+		}
+	}
+	sort.Sort(byScore{nodes, scores})
+	return nodes
+}
+
+// GraphDepth returns the length of the longest chain of imports starting at
+// the node, recording it, and that of every package below it, in depths.
+func GraphDepth(graph map[string][]string, node string,
+	depths map[string]float64) float64 {
+	if depth, ok := depths[node]; ok {
+		return depth
+	}
+	// guard against cycles
+	depths[node] = 0
+	depth := 0.0
+	for _, dep := range graph[node] {
+		if d := GraphDepth(graph, dep, depths) + 1; d > depth {
+			depth = d
+		}
+	}
+	depths[node] = depth
+	return depth
 }
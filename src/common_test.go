@@ -0,0 +1,76 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	. "container/vector"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// the files of the fixture tree, some hidden or within hidden directories
+var fixtureFiles = []string{
+	"a.go",
+	".hidden.go",
+	".git/objects.go",
+	"sub/b.go",
+	"sub/.cache/c.go",
+	".dir/sub/d.go",
+}
+
+// makeFixture writes the fixture tree to a temporary directory, returning it.
+func makeFixture(t *testing.T) string {
+	root, err := ioutil.TempDir("", "godep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range fixtureFiles {
+		fpath := path.Join(root, fname)
+		if err = os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fpath, []byte("package main\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// findFiles walks the tree with GoFileFinder, returning the files found
+// relative to the root, sorted.
+func findFiles(root string, skip bool) string {
+	skipDotFiles = skip
+	files = StringVector{}
+	filepath.Walk(root, GoFileFinder{}, nil)
+	found := StringVector{}
+	for _, fpath := range files {
+		found.Push(fpath[len(root)+1:])
+	}
+	sort.Sort(&found)
+	return strings.Join(found, " ")
+}
+
+func TestSkipDotFiles(t *testing.T) {
+	root := makeFixture(t)
+	defer os.RemoveAll(root)
+	if found := findFiles(root, true); found != "a.go sub/b.go" {
+		t.Errorf("skipping dot files, found %s", found)
+	}
+	// a copy, so that the fixture keeps its order
+	all := StringVector{}
+	for _, fname := range fixtureFiles {
+		all.Push(fname)
+	}
+	sort.Sort(&all)
+	if found := findFiles(root, false); found != strings.Join(all, " ") {
+		t.Errorf("not skipping dot files, found %s", found)
+	}
+}
@@ -5,229 +5,4934 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	. "container/vector"
+	"exec"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io"
+	"io/ioutil"
+	"json"
 	"opts"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"tabwriter"
+	"time"
 )
 
 var showVersion = opts.LongFlag("version", "display version information")
 var showNeeded = opts.Flag("n", "need", "display external dependencies")
 var srcRoot = opts.Half("r", "root", "root directory of the source", "", "src")
+var emitCoverage = opts.LongFlag("coverage", "display coverage targets")
+var stubMissing = opts.LongFlag("stub-missing",
+	"display failing targets for external dependencies")
+var noMain = opts.LongFlag("no-main", "ignore the main package")
+var emitVet = opts.LongFlag("emit-vet", "display vet targets")
+var packageFilter = opts.LongSingle("package-filter",
+	"only handle packages whose names match the given regexp", "")
+var fileEncoding = opts.LongSingle("file-encoding",
+	"encoding of the source files (utf-8, latin1, windows-1252)", "utf-8")
+var printPath = opts.LongFlag("print-path",
+	"display the directory holding each package")
+var arch = opts.LongSingle("arch",
+	"architecture to use the object file extension of", "")
+var emitTimestamp = opts.LongFlag("emit-timestamp",
+	"display the time of generation")
+var noTimestamp = opts.LongFlag("no-timestamp",
+	"never display the time of generation")
+var snapshotDir = opts.LongSingle("output",
+	"directory to write a snapshot to", "snapshot")
+var restoreDir = opts.LongSingle("from",
+	"directory to restore a snapshot from", "snapshot")
+var warnUnused = opts.LongFlag("warn-unused-files",
+	"warn about files not belonging to any package")
+var emitEnv = opts.LongFlag("emit-env",
+	"display the build environment as variables")
+var objDir = opts.LongSingle("pkg-obj-dir",
+	"directory to place object files in", "")
+var ignoreGenerated = opts.LongFlag("ignore-generated",
+	"skip files generated by other tools")
+var stripVendor = opts.LongFlag("strip-vendor-prefix",
+	"remove the leading vendor/ from target names")
+var relativeTo = opts.LongSingle("relative-to",
+	"file to make the displayed paths relative to", "")
+var emitModulePath = opts.LongFlag("emit-module-path",
+	"display the module providing each external dependency")
+var bazelBuild = opts.LongSingle("emit-bazel-build",
+	"file to also write bazel build rules to", "")
+var coalesce = opts.LongFlag("coalesce-packages",
+	"merge single-file packages into their only importer")
+var adjacencyMatrix = opts.LongFlag("adjacency-matrix",
+	"display the import graph as a CSV adjacency matrix")
+var detectMains = opts.LongFlag("detect-main-packages",
+	"make an executable of each directory with a main function")
+var emitRace = opts.LongFlag("emit-race",
+	"run the race detector in test targets")
+var outputDir = opts.LongSingle("output-dir",
+	"directory to write a fragment per package to", "")
+var withFiles = opts.LongFlag("with-files",
+	"list the files of each package along with it")
+var noImplicitStdlib = opts.LongFlag("no-implicit-stdlib",
+	"never look for the standard library under $GOROOT")
+var stdlibPath = opts.LongSingle("stdlib-path",
+	"directory holding the standard library sources", "")
+var newerThan = opts.LongSingle("newer-than",
+	"only display packages changed since the given RFC3339 time", "")
+var emitGodocLinks = opts.LongFlag("emit-godoc-links",
+	"display documentation links for external dependencies")
+var statsTop = opts.LongSingle("top",
+	"number of packages to display statistics for", "10")
+var emitBenchmark = opts.LongFlag("emit-benchmark",
+	"display benchmark targets")
+var emitGowork = opts.LongFlag("emit-gowork",
+	"also write a go.work file using every module found")
+var ignoreParseErrors = opts.LongFlag("ignore-parse-errors",
+	"carry on past files which fail to parse")
+var denyLicenses = opts.LongSingle("deny",
+	"comma-separated SPDX ids of licenses to reject", "")
+var emitStaticcheck = opts.LongFlag("emit-staticcheck",
+	"display staticcheck and lint targets")
+var graphDB = opts.LongSingle("db",
+	"SQLite database to export the graph to", "godep.db")
+var maxFiles = opts.LongSingle("max-files",
+	"analyze at most this many files", "")
+var serverMode = opts.LongFlag("server",
+	"answer JSON requests on standard input")
+var emitInstallScript = opts.LongFlag("emit-install-script",
+	"write a build.sh shell script instead of a Makefile")
+var sortBy = opts.LongSingle("sort-by",
+	"order of the targets: name, size, deps or depth", "name")
+var hideExternal = opts.LongFlag("hide-external-paths",
+	"replace external import paths with placeholder names")
+var coverageThreshold = opts.LongSingle("coverage-threshold",
+	"display a test target failing below this coverage percentage", "")
+var fixCycles = opts.LongFlag("fix",
+	"with check-cycles, remove imports to break each cycle")
+var machineName = opts.LongSingle("machine-name",
+	"name of the machine to note in the output", hostname())
+var cpuProfile = opts.LongSingle("pprof-cpu",
+	"file to write a CPU profile of godep to", "")
+var memProfile = opts.LongSingle("pprof-mem",
+	"file to write a memory profile of godep to", "")
+var buildTags = opts.LongSingle("tags",
+	"build tags to suggest in GOFLAGS", "")
+var compressDeps = opts.LongFlag("compress-deps",
+	"leave out prerequisites implied by other prerequisites")
+var preAnalyzeHook = opts.LongSingle("hook-pre-analyze",
+	"command filtering the list of files before parsing", "")
+var postAnalyzeHook = opts.LongSingle("hook-post-analyze",
+	"command printing extra lines to output after analysis", "")
+var omitPackages = opts.LongMulti("omit-pkg",
+	"package to leave out of the output entirely", "")
+var emitJSON = opts.LongFlag("json",
+	"print the packages, with their files and imports, as JSON")
+var skipDot = opts.LongFlag("skip-dot-files",
+	"skip hidden files and directories (the default)")
+var noSkipDot = opts.LongFlag("no-skip-dot-files",
+	"also analyze hidden files and directories")
+var nameConflict = opts.LongSingle("package-name-conflict",
+	"what to do with a package name used in several directories: "+
+		"merge, warn or error", "error")
+var warnLarge = opts.LongSingle("warn-large-package",
+	"warn of packages with more than this many files", "")
+var forceExternal = opts.LongMulti("force-external",
+	"import path prefix of packages to treat as external", "")
+var emitGoBuild = opts.LongFlag("emit-go-build",
+	"print go build commands instead of a Makefile")
+var emitLink = opts.LongFlag("emit-link-target",
+	"display rules linking each executable")
+var namingSkip = opts.LongMulti("naming-skip",
+	"naming rule for check-naming to skip: underscore, case, dir or test", "")
+var debugAST = opts.LongSingle("debug-ast",
+	"print the syntax tree of the given file, and exit", "")
+var emitConditionals = opts.LongFlag("emit-makefile-conditionals",
+	"list platform-specific files within ifeq blocks")
+var reportFile = opts.LongSingle("report-file",
+	"file to write a JSON report of the analysis to", "")
+var watchExec = opts.LongSingle("exec",
+	"with watch, command to run with the changed packages", "")
+var watchDelay = opts.LongSingle("watch-delay",
+	"with watch, milliseconds to wait for changes to settle", "500")
+var importPrefix = opts.LongSingle("import-prefix",
+	"import path to prefix the targets of local packages with", "")
+var splitAt = opts.LongSingle("split-at",
+	"most package targets in each of several fragments", "")
+var protoOutput = opts.LongSingle("proto-output",
+	"file to also write the graph to as a protocol buffer", "")
+var emitCompileFlags = opts.LongFlag("emit-compile-flags",
+	"display compile recipes with the compiler flags of each package")
+var phonyFile = opts.LongSingle("emit-phony-file",
+	"file to write the phony targets to, and include", "")
+var emitGoWork = opts.LongFlag("emit-go-work", "same as --emit-gowork")
+var goListCompat = opts.LongFlag("go-list-compat",
+	"print the packages as go list does, instead of a Makefile")
+var verifyFile = opts.LongSingle("verify",
+	"fragment to check is up to date, instead of printing the Makefile", "")
 var progName = "godep"
 
+// the arguments given on the command line, recorded in the Makefile
+var commandLine []string
+
 var roots = map[string]string{}
 
+// where the output is written
+var out io.Writer = os.Stdout
+
+// with --newer-than, only packages changed since this time, in seconds, are
+// displayed
+var since int64
+
+// the extension of object files; fixed if --arch is given
+var objExt = "${O}"
+
+// commands which may be given in place of the first file, each printing
+// something other than the dependency tree
+var commands = map[string]func(){
+	"dot-weight":     PrintDotWeight,
+	"snapshot":       Snapshot,
+	"graph-metrics":  PrintGraphMetrics,
+	"unused-imports": PrintUnusedImports,
+	"packages":       PrintPackages,
+	"stats":          PrintStats,
+	"license-check":  LicenseCheck,
+	"export-graph":   ExportGraph,
+	"clean":          Clean,
+	"self-test":      SelfTest,
+	"check-cycles":   CheckCycles,
+	"pin":            Pin,
+	"verify-pin":     VerifyPin,
+	"list-external":  ListExternal,
+	"check-api":      CheckAPI,
+	"check-naming":   CheckNaming,
+	"coverage-map":   PrintCoverageMap,
+	"check-stdlib":   CheckStdlib,
+}
+
+// commands which work on something other than the source files, and so are
+// run before any analysis, with the remaining arguments
+var tools = map[string]func(args []string){
+	"format":            FormatFragment,
+	"restore":           Restore,
+	"impact":            PrintImpact,
+	"explain-target":    ExplainTarget,
+	"summarize-changes": SummarizeChanges,
+	"rename-package":    RenamePackage,
+	"watch":             Watch,
+	"graph-diff":        GraphDiff,
+}
+
+// commands taking package names as arguments
+var packageCommands = []string{"explain-target", "rename-package"}
+
+func init() {
+	// registered here, as it refers to the tables above
+	tools["completions"] = Completions
+}
+
 // prefix the root
 func mkRoot(str string) string {
-	return path.Join(*srcRoot, str)
+	if *stripVendor && strings.HasPrefix(str, "vendor/") {
+		str = str[len("vendor/"):]
+	}
+	if _, ok := packages[str]; ok && *importPrefix != "" {
+		str = path.Join(*importPrefix, str)
+	}
+	return mkPath(path.Join(*srcRoot, str))
+}
+
+// make a path relative to the file given by --relative-to, if any
+func mkPath(str string) string {
+	if *relativeTo == "" {
+		return str
+	}
+	rel, err := filepath.Rel(filepath.Dir(*relativeTo), str)
+	if err != nil {
+		return str
+	}
+	return rel
+}
+
+// the project configuration file
+const configFile = "godep.toml"
+
+// GivenOptions returns the long options given in the arguments, by name.
+func GivenOptions(args []string) map[string]bool {
+	given := map[string]bool{}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		name := arg[len("--"):]
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		given[name] = true
+	}
+	return given
+}
+
+// ConfigArgs reads the named configuration file, if there is one, and
+// returns the arguments given with its settings added as long options, for
+// those options not given already, so that the command line takes
+// precedence. The file holds a subset of TOML: each line sets a key, the
+// name of an option, to a string, number or boolean, or an array of these,
+// giving the option once for each element. An option set to false is not
+// given at all, and one set to true may be turned off with --key=false.
+func ConfigArgs(fname string, args []string) []string {
+	config, err := ReadConfig(fname)
+	if err != nil {
+		return args
+	}
+	settings := map[string]string{}
+	keys := StringVector{}
+	for key, value := range config {
+		if strings.HasPrefix(key, "#") {
+			continue
+		}
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		settings[key] = value
+		keys.Push(key)
+	}
+	sort.Sort(&keys)
+	// the flags turned off on the command line are not given at all
+	given := GivenOptions(args)
+	cmdline := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") && strings.HasSuffix(arg, "=false") {
+			key := arg[len("--") : len(arg)-len("=false")]
+			if _, ok := settings[key]; ok {
+				continue
+			}
+		}
+		cmdline = append(cmdline, arg)
+	}
+	combined := []string{}
+	for _, key := range keys {
+		if given[key] {
+			continue
+		}
+		value := settings[key]
+		values := []string{value}
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			values = strings.Split(value[1:len(value)-1], ",", -1)
+		}
+		for _, value := range values {
+			value = strings.Trim(strings.TrimSpace(value), "\"")
+			switch value {
+			case "true":
+				combined = append(combined, "--"+key)
+			case "false", "":
+			default:
+				combined = append(combined, "--"+key+"="+value)
+			}
+		}
+	}
+	return append(combined, cmdline...)
+}
+
+// hostname returns the name of this machine, if it can be found.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// name the object file built from str
+func mkObj(str string) string {
+	return path.Join(*objDir, str+"."+objExt)
 }
 
 func main() {
-	opts.Usage = "[file1.go [...]]"
+	opts.Usage = "[command] [file1.go [...]]"
 	opts.Description =
 		`construct and print a dependency tree for the given source files.`
 		// parse and handle options
+	commandLine = os.Args[1:]
+	os.Args = append([]string{os.Args[0]},
+		ConfigArgs(configFile, os.Args[1:])...)
 	opts.Parse()
 	if *showVersion {
 		ShowVersion()
 		os.Exit(0)
 	}
-	// if there are no files, generate a list
-	if len(opts.Args) == 0 {
-		filepath.Walk(".", GoFileFinder{}, nil)
-	} else {
-		for _, fname := range opts.Args {
-			files.Push(fname)
-		}
+	skipDotFiles = *skipDot || !*noSkipDot
+	if *cpuProfile != "" {
+		StartCPUProfile()
+		defer pprof.StopCPUProfile()
 	}
-	// for each file, list dependencies
-	for _, fname := range files {
-		fset := token.NewFileSet()
-		file, err := parser.ParseFile(fset, fname, nil, parser.ImportsOnly)
+	if *memProfile != "" {
+		defer WriteMemProfile()
+	}
+	if *noImplicitStdlib && *stdlibPath == "" {
+		fmt.Fprint(os.Stderr, "--no-implicit-stdlib requires --stdlib-path\n")
+		os.Exit(1)
+	}
+	if *newerThan != "" {
+		t, err := time.Parse(time.RFC3339, *newerThan)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
 			os.Exit(1)
 		}
-		HandleFile(fname, file)
+		since = t.Seconds()
 	}
-	PrintAutoNotice()
-	FindMain()
+	if *arch != "" {
+		char, ok := archChars[*arch]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown architecture: %s\n", *arch)
+			os.Exit(1)
+		}
+		objExt = char
+	}
+	if !sortCriteria[*sortBy] {
+		fmt.Fprintf(os.Stderr, "unknown sort criterion: %s\n", *sortBy)
+		os.Exit(1)
+	}
+	// these print, for each external dependency, what gives its path away
+	if *hideExternal && (*emitGodocLinks || *emitModulePath || *printPath) {
+		fmt.Fprint(os.Stderr, "--hide-external-paths cannot be used with "+
+			"--emit-godoc-links, --emit-module-path or --print-path\n")
+		os.Exit(1)
+	}
+	// report the files skipped by --ignore-parse-errors, for tools as well
+	defer ReportParseErrors()
+	if len(opts.Args) > 0 {
+		if tool, ok := tools[opts.Args[0]]; ok {
+			tool(opts.Args[1:])
+			return
+		}
+	}
+	if *serverMode {
+		Serve()
+		return
+	}
+	if *debugAST != "" {
+		PrintAST(*debugAST)
+		return
+	}
+	// a leading command name selects what to print
+	var command func()
+	if len(opts.Args) > 0 {
+		if cmd, ok := commands[opts.Args[0]]; ok {
+			command = cmd
+			opts.Args = opts.Args[1:]
+		}
+	}
+	Analyze(opts.Args)
+	if command != nil {
+		command()
+		return
+	}
+	if *adjacencyMatrix {
+		PrintAdjacencyMatrix()
+		return
+	}
+	if *emitInstallScript {
+		WriteInstallScript("build.sh")
+		return
+	}
+	if *emitJSON {
+		PrintJSON()
+		return
+	}
+	if *emitGoBuild {
+		PrintGoBuild()
+		return
+	}
+	if *goListCompat {
+		PrintGoList()
+		return
+	}
+	if *verifyFile != "" {
+		VerifyMakefile(*verifyFile)
+		return
+	}
+	if *outputDir != "" {
+		out = CreateOutput(path.Join(*outputDir, "all.mk"))
+	}
+	PrintMakefile()
+	if *reportFile != "" {
+		WriteReport(*reportFile)
+	}
+	if *protoOutput != "" {
+		WriteProto(*protoOutput)
+	}
+}
+
+// precedes the command line generating a Makefile, for VerifyMakefile and
+// the hooks of gorules
+const commandPrefix = "# Generated with: "
+
+// precedes the time of generation, which VerifyMakefile ignores
+const timestampPrefix = "# Generated by godep at "
+
+// GeneratingCommand returns the command line given to godep, quoted for the
+// shell, and without --verify.
+func GeneratingCommand() string {
+	words := StringVector{progName}
+	for i := 0; i < len(commandLine); i++ {
+		arg := commandLine[i]
+		if arg == "--verify" {
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg, "--verify=") {
+			continue
+		}
+		words.Push(ShellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// VerifyMakefile exits with an error if the named fragment differs from the
+// Makefile godep would print, apart from the time of generation.
+func VerifyMakefile(fname string) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	var buffer bytes.Buffer
+	out = &buffer
+	PrintMakefile()
+	out = os.Stdout
+	if WithoutTimestamp(buffer.String()) != WithoutTimestamp(string(content)) {
+		fmt.Fprintf(os.Stderr, "%s is stale; regenerate it with %s\n",
+			fname, GeneratingCommand())
+		os.Exit(1)
+	}
+}
+
+// WithoutTimestamp returns a Makefile without its time of generation.
+func WithoutTimestamp(makefile string) string {
+	lines := StringVector{}
+	for _, line := range strings.Split(makefile, "\n", -1) {
+		if !strings.HasPrefix(line, timestampPrefix) {
+			lines.Push(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WriteReport writes a JSON report of the analysis to the named file: the
+// number of packages and files, the external dependencies, and those whose
+// source is not found, the import cycles, and the large packages.
+func WriteReport(fname string) {
+	external := ExternalPackages()
+	sort.Sort(&external)
+	missing := StringVector{}
+	for _, pkgname := range external {
+		if _, err := os.Stat(PackagePath(pkgname)); err != nil {
+			missing.Push(pkgname)
+		}
+	}
+	cycles := StringVector{}
+	for _, cycle := range FindCycles() {
+		cycles.Push(strings.Join(cycle, " -> ") + " -> " + cycle[0])
+	}
+	large := map[string]int{}
+	nfiles := 0
+	for pkgname, pkg := range packages {
+		nfiles += pkg.files.Len()
+		if IsLarge(pkgname) {
+			large[pkgname] = pkg.files.Len()
+		}
+	}
+	report := map[string]interface{}{
+		"packages":       len(packages),
+		"files":          nfiles,
+		"external":       external,
+		"missing":        missing,
+		"cycles":         cycles,
+		"large_packages": large,
+	}
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(fname, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// PrintMakefile prints the dependencies, and every target asked for.
+func PrintMakefile() {
+	phony = StringVector{}
+	FprintAutoNotice(out)
+	fmt.Fprintf(out, "%s%s\n", commandPrefix, GeneratingCommand())
+	if *hideExternal {
+		HideExternals()
+	}
+	if *emitTimestamp && !*noTimestamp {
+		fmt.Fprintf(out, "%s%s\n", timestampPrefix,
+			time.UTC().Format(time.RFC3339))
+	}
+	if *machineName != "" {
+		fmt.Fprintf(out, "# Generated on %s\n", *machineName)
+	}
+	if *phonyFile != "" {
+		fmt.Fprintf(out, "include %s\n", *phonyFile)
+	}
+	if *emitEnv {
+		PrintEnv()
+	}
+	if *arch != "" {
+		fmt.Fprintf(out, "O=%s\n", objExt)
+	}
+	PrintGoflags()
 	if *showNeeded {
 		PrintNeeded(".EXTERNAL: ", ".a")
 	}
 	// in any case, print as a comment
 	PrintNeeded("# external packages: ", "")
-	PrintDeps()
+	PrintNoSumCheck()
+	if *emitGodocLinks {
+		PrintGodocLinks()
+	}
+	if *emitModulePath {
+		ReadModules()
+		if !*stubMissing {
+			PrintModules()
+		}
+	}
+	if skipped.Len() > 0 {
+		fmt.Fprintf(out, "# generated files skipped: %s\n",
+			strings.Join(skipped, " "))
+	}
+	if *printPath {
+		PrintPaths()
+	}
+	switch {
+	case *outputDir != "":
+		WritePackageFragments()
+	case *splitAt != "":
+		WriteSplitFragments()
+	default:
+		PrintDeps()
+	}
+	if *emitLink {
+		PrintLink()
+	}
+	PrintSwig()
+	if *stubMissing {
+		PrintStubs()
+	}
+	PrintGenerate()
+	if *bazelBuild != "" {
+		WriteBazelBuild(*bazelBuild)
+	}
+	if *emitGowork || *emitGoWork {
+		WriteGowork()
+	}
+	if *emitCoverage {
+		PrintCoverage()
+	}
+	if *coverageThreshold != "" {
+		PrintCoverageThreshold()
+	}
+	PrintTestRace()
+	if *emitBenchmark {
+		PrintBenchmark()
+	}
+	if *emitVet {
+		PrintVet()
+	}
+	if *emitStaticcheck {
+		PrintStaticcheck()
+	}
+	PrintPhony()
+	if *postAnalyzeHook != "" {
+		out.Write(RunHook(*postAnalyzeHook))
+	}
 }
 
-type Package struct {
-	name     string
-	files    *StringVector     // the files in this package
-	packages map[string]string // dependencies
-	hasMain  bool              // is this a main package with a `main` function
-	path     string            // the path to this package
+// the targets printed which do not name files
+var phony = StringVector{}
+
+// Phony records the target as phony.
+func Phony(target string) {
+	phony.Push(target)
 }
 
-// packages is a mapping of package names (strings) to Package objects
-var packages = map[string]Package{}
+// PrintPhony declares the phony targets printed, in a .PHONY rule, or in
+// the file given by --emit-phony-file, one per line.
+func PrintPhony() {
+	if phony.Len() == 0 {
+		return
+	}
+	sort.Sort(&phony)
+	if *phonyFile == "" {
+		fmt.Fprintf(out, ".PHONY: %s\n", strings.Join(phony, " "))
+		return
+	}
+	file := CreateOutput(*phonyFile)
+	defer file.Close()
+	for _, target := range phony {
+		fmt.Fprintf(file, ".PHONY: %s\n", target)
+	}
+}
 
-// FindMain finds all files which are in package 'main' and have a 'main'
-// function.
-func FindMain() {
-	// for each file in the main package
-	if pkg, ok := packages["main"]; ok {
-		for _, fname := range *pkg.files {
-			fset := token.NewFileSet()
-			file, _ := parser.ParseFile(fset, fname, nil, 0)
-			ast.Walk(&MainCheckVisitor{fname}, file)
-		}
+// RunHook runs the shell command, giving it the list of files, one per line,
+// on its standard input, and returns its output.
+func RunHook(command string) []byte {
+	input := strings.Join(files, "\n")
+	if len(files) > 0 {
+		input += "\n"
 	}
+	output := bytes.NewBuffer(nil)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+		os.Exit(1)
+	}
+	return output.Bytes()
 }
 
-// PrintNeeded prints out a list of external dependencies to standard output.
-func PrintNeeded(pre, ppost string) {
-	// dependencies already displayed
-	done := map[string]bool{}
-	// start the list
-	fmt.Print(pre)
-	// for each package
-	for _, pkg := range packages {
-		// print all packages for which we don't have the source
-		for _, pkgname := range pkg.packages {
-			if _, ok := packages[pkgname]; !ok && !done[pkgname] {
-				fmt.Printf("%s%s ", pkgname, ppost)
-				done[pkgname] = true
-			}
-		}
+// SelfTest writes the Makefile to a temporary file, and checks that make can
+// read it, with a dry run.
+func SelfTest() {
+	file, err := ioutil.TempFile("", "godep")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
-	fmt.Print("\n")
+	defer os.Remove(file.Name())
+	stdout := out
+	out = file
+	PrintMakefile()
+	out = stdout
+	file.Close()
+	cmd := exec.Command("make", "--dry-run", "-f", file.Name())
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(out, "self-test: FAIL: %s\n", err)
+		os.Remove(file.Name())
+		os.Exit(1)
+	}
+	fmt.Fprint(out, "self-test: ok\n")
 }
 
-// PrintDeps prints out the dependency lists to standard output.
-func PrintDeps() {
-	// for each package
-	for pkgname, pkg := range packages {
-		if pkgname != "main" {
-			// start the list
-			fmt.Printf("%s.a: ", mkRoot(pkgname))
-			// print all the files
-			for _, fname := range *pkg.files {
-				fmt.Printf("%s ", fname)
-			}
-			// print all packages for which we have the source
-			// exception: if -n was supplied, print all packages
-			for _, pkgname := range pkg.packages {
-				_, ok := packages[pkgname]
-				if ok || *showNeeded {
-					fmt.Printf("%s.a ", mkRoot(pkgname))
-				}
-			}
-			fmt.Printf("\n")
+// PrintAST parses the named file as the analysis would, and prints its
+// syntax tree.
+func PrintAST(fname string) {
+	if !MatchesTarget(fname) {
+		fmt.Fprintf(os.Stderr, "warning: %s is not built for the target\n",
+			fname)
+	}
+	src, err := ReadSource(fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	file, err := parser.ParseFile(fset, fname, src, parser.ParseComments)
+	if err == nil {
+		_, err = ast.Print(fset, file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// StartCPUProfile starts profiling godep, writing to the file given by
+// --pprof-cpu until the profile is stopped.
+func StartCPUProfile() {
+	file, err := os.Create(*cpuProfile)
+	if err == nil {
+		err = pprof.StartCPUProfile(file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// WriteMemProfile writes a profile of the memory held by godep to the file
+// given by --pprof-mem.
+func WriteMemProfile() {
+	file, err := os.Create(*memProfile)
+	if err == nil {
+		err = pprof.WriteHeapProfile(file)
+		file.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// the errors from files skipped due to --ignore-parse-errors
+var parseErrors = []os.Error{}
+
+// keepParsing skips the files which fail to parse, as --ignore-parse-errors
+// does, for the modes which report the errors as they go
+var keepParsing = false
+
+// ReportParseErrors prints all errors collected while parsing, and exits
+// with an error if there were any.
+func ReportParseErrors() {
+	for _, err := range parseErrors {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+	if len(parseErrors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// IgnoreFiles drops from the list of files those matching any pattern in
+// the named ignore file, if it exists. Each line is a pattern, matched with
+// filepath.Match against the path and the base name of each file; lines
+// starting with '#' are comments.
+func IgnoreFiles(ignoreFile string) {
+	content, err := ioutil.ReadFile(ignoreFile)
+	if err != nil {
+		return
+	}
+	patterns := StringVector{}
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns.Push(line)
 		}
 	}
-	common := StringVector{}
-	// for the main package
-	if main, ok := packages["main"]; ok {
-		// consider all files not found in 'roots' to be common to
-		// everything in this package
-		for _, fname := range *main.files {
-			if app, ok := roots[fname]; ok {
-				fmt.Printf("%s: %s.${O}\n", app, app)
-			} else {
-				common.Push(fname)
+	kept := StringVector{}
+	for _, fname := range files {
+		ignored := false
+		for _, pattern := range patterns {
+			byPath, _ := filepath.Match(pattern, path.Clean(fname))
+			byName, _ := filepath.Match(pattern, path.Base(fname))
+			if byPath || byName {
+				ignored = true
+				break
 			}
 		}
-		// for every application root
-		for _, fname := range *main.files {
-			if app, ok := roots[fname]; ok {
-				// dependencies already displayed
-				done := map[string]bool{}
-				// print the file
-				fmt.Printf("%s.${O}: %s ", app, fname)
-				// print the common files
-				for _, cfile := range common {
-					fmt.Printf("%s ", cfile)
-				}
-				// print all packages for which we have the
-				// source, or, if -n was supplied, print all
-				for _, pkgname := range main.packages {
-					_, ok := packages[pkgname]
-					if ok || (*showNeeded && !done[pkgname]) {
-						fmt.Printf("%s.a ", mkRoot(pkgname))
-						done[pkgname] = true
-					}
-				}
-				fmt.Printf("\n")
-			}
+		if !ignored {
+			kept.Push(fname)
 		}
 	}
+	files = kept
 }
 
-func HandleFile(fname string, file *ast.File) {
-	pkgname := file.Name.Name
-	if pkg, ok := packages[pkgname]; ok {
-		pkg.files.Push(fname)
-	} else {
-		packages[pkgname] = Package{
-			files:    &StringVector{},
-			packages: map[string]string{},
-			hasMain:  false,
+// IsForcedExternal reports whether the package, by its path, starts with a
+// prefix given by --force-external, and so is never analyzed.
+func IsForcedExternal(ppath string) bool {
+	for _, prefix := range *forceExternal {
+		if strings.HasPrefix(ppath, prefix) {
+			return true
 		}
-		packages[pkgname].files.Push(fname)
 	}
-	ast.Walk(&ImportVisitor{packages[pkgname]}, file)
+	return false
 }
 
-//
-// ImportVisitor
-//
-// Finds a lists all imports for the scanned file.
-//
-
-type ImportVisitor struct {
-	pkg Package
+// CheckNameConflicts looks for packages, other than main, whose files are in
+// more than one directory. As given by --package-name-conflict, their files
+// are merged into one package, with a warning or without, or an error naming
+// them is returned.
+func CheckNameConflicts() os.Error {
+	switch *nameConflict {
+	case "merge":
+		return nil
+	case "warn", "error":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown --package-name-conflict: %s\n",
+			*nameConflict)
+		os.Exit(1)
+	}
+	names := StringVector{}
+	for pkgname, pkg := range packages {
+		if pkgname != "main" && len(PackageDirs(pkg)) > 1 {
+			names.Push(pkgname)
+		}
+	}
+	sort.Sort(&names)
+	conflicts := StringVector{}
+	for _, pkgname := range names {
+		dirs := PackageDirs(packages[pkgname])
+		conflicts.Push(fmt.Sprintf("%s: package %s is declared in %s",
+			*nameConflict, pkgname, strings.Join(dirs, ", ")))
+	}
+	if conflicts.Len() > 0 && *nameConflict == "error" {
+		return os.NewError(strings.Join(conflicts, "\n"))
+	}
+	for _, conflict := range conflicts {
+		fmt.Fprintf(os.Stderr, "%s\n", conflict)
+	}
+	return nil
 }
 
-func (v ImportVisitor) Visit(node ast.Node) ast.Visitor {
-	// check the type of the node
-	if spec, ok := node.(*ast.ImportSpec); ok {
-		ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
-		if _, ok = v.pkg.packages[ppath]; !ok {
-			v.pkg.packages[ppath] = ppath
+// the number of files above which a package is large, or -1
+var largeLimit = -1
+
+// WarnLargePackages warns of each package with more files than given by
+// --warn-large-package.
+func WarnLargePackages() {
+	limit, err := strconv.Atoi(*warnLarge)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	largeLimit = limit
+	names := StringVector{}
+	for pkgname := range packages {
+		if IsLarge(pkgname) {
+			names.Push(pkgname)
 		}
 	}
-	return v
+	sort.Sort(&names)
+	for _, pkgname := range names {
+		fmt.Fprintf(os.Stderr, "warning: package %s is large (%d files)\n",
+			pkgname, packages[pkgname].files.Len())
+	}
+}
+
+// IsLarge reports whether the named package has more files than given by
+// --warn-large-package.
+func IsLarge(pkgname string) bool {
+	pkg, ok := packages[pkgname]
+	return ok && largeLimit >= 0 && pkg.files.Len() > largeLimit
+}
+
+// OmitPackage drops the named package, and every import of it, so that it
+// appears nowhere in the output.
+func OmitPackage(pkgname string) {
+	packages[pkgname] = Package{}, false
+	for _, pkg := range packages {
+		pkg.packages[pkgname] = "", false
+		pkg.weights[pkgname] = 0, false
+	}
+}
+
+// FileLimit returns the number of files given by --max-files, or -1 if
+// there is no limit.
+func FileLimit() int {
+	if *maxFiles == "" {
+		return -1
+	}
+	limit, err := strconv.Atoi(*maxFiles)
+	if err != nil || limit < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --max-files: %s\n", *maxFiles)
+		os.Exit(1)
+	}
+	return limit
 }
 
 //
-// MainCheckVisitor
+// LimitedFinder
 //
-// Used to check for a function named 'main' (usually in a package named 
-// 'main'), to decide if a package should be made into its own executable.
+// Finds go files as GoFileFinder does, in lexicographic order, stopping once
+// more than limit are found.
 //
 
-type MainCheckVisitor struct {
-	fname string
+type LimitedFinder struct {
+	limit int
 }
 
-func addRoot(filename string) {
-	fparts := strings.Split(filename, ".", -1)
-	basename := fparts[0]
-	roots[filename] = basename
+func (f LimitedFinder) VisitDir(dpath string, finfo *os.FileInfo) bool {
+	return len(files) <= f.limit && GoFileFinder{}.VisitDir(dpath, finfo)
+}
+
+func (f LimitedFinder) VisitFile(fpath string, finfo *os.FileInfo) {
+	if len(files) <= f.limit {
+		GoFileFinder{}.VisitFile(fpath, finfo)
+	}
+}
+
+// LimitFiles keeps the first --max-files files, in lexicographic order,
+// warning when any are dropped.
+func LimitFiles(limit int) {
+	if len(files) <= limit {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "warning: found more than %d files, analyzing "+
+		"only the first %d\n", limit, limit)
+	sort.Sort(&files)
+	files = files[:limit]
 }
 
-func (v MainCheckVisitor) Visit(node ast.Node) ast.Visitor {
-	if decl, ok := node.(*ast.FuncDecl); ok {
-		if decl.Name.Name == "main" {
-			addRoot(v.fname)
+// Analyze parses the given files, or all go files below the current
+// directory if there are none, and builds the dependency tree. Errors in the
+// tree, such as conflicting package names, are returned in the modes which
+// keep parsing, and are otherwise fatal.
+func Analyze(args []string) os.Error {
+	limit := FileLimit()
+	// if there are no files, generate a list, stopping early if there are
+	// more than --max-files
+	if len(args) == 0 && limit >= 0 {
+		filepath.Walk(".", LimitedFinder{limit}, nil)
+	} else if len(args) == 0 {
+		filepath.Walk(".", GoFileFinder{}, nil)
+	} else {
+		for _, fname := range args {
+			files.Push(fname)
 		}
 	}
-	return v
+	IgnoreFiles(".godepignore")
+	if limit >= 0 {
+		LimitFiles(limit)
+	}
+	if *preAnalyzeHook != "" {
+		output := string(RunHook(*preAnalyzeHook))
+		files = StringVector{}
+		for _, line := range strings.Split(output, "\n", -1) {
+			if line = strings.TrimSpace(line); line != "" {
+				files.Push(line)
+			}
+		}
+	}
+	var filter *regexp.Regexp
+	if *packageFilter != "" {
+		var err os.Error
+		filter, err = regexp.Compile(*packageFilter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+	// for each file, list dependencies
+	for _, fname := range files {
+		file, ok := CachedFile(fname)
+		if !ok {
+			src, err := ReadSource(fname)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			if *ignoreGenerated && IsGenerated(src) {
+				skipped.Push(fname)
+				continue
+			}
+			file, err = parser.ParseFile(fset, fname, src, parser.ParseComments)
+			if err != nil && (*ignoreParseErrors || keepParsing) {
+				parseErrors = append(parseErrors, err)
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			CacheFile(fname, file)
+		}
+		// skip files in packages not matching the filter
+		if filter != nil && !filter.MatchString(file.Name.Name) {
+			continue
+		}
+		if IsForcedExternal(file.Name.Name) ||
+			IsForcedExternal(path.Dir(path.Clean(fname))) {
+			continue
+		}
+		HandleFile(fname, file)
+	}
+	if err := CheckNameConflicts(); err != nil {
+		if keepParsing {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if *noMain {
+		packages["main"] = Package{}, false
+	}
+	for _, pkgname := range *omitPackages {
+		OmitPackage(pkgname)
+	}
+	if *warnUnused {
+		WarnUnusedFiles()
+	}
+	if *warnLarge != "" {
+		WarnLargePackages()
+	}
+	FindMain()
+	FindSwig()
+	if *coalesce {
+		CoalescePackages()
+	}
+	return nil
+}
+
+type Package struct {
+	name       string
+	files      *StringVector     // the files in this package
+	packages   map[string]string // dependencies
+	hasMain    bool              // is this a main package with a `main` function
+	path       string            // the path to this package
+	generators *StringVector     // files with //go:generate directives
+	weights    map[string]int    // number of files importing each dependency
+}
+
+// packages is a mapping of package names (strings) to Package objects
+var packages = map[string]Package{}
+
+// parsed maps the name of each handled file to its syntax tree
+var parsed = map[string]*ast.File{}
+
+// positions within all parsed files
+var fset = token.NewFileSet()
+
+// generated files skipped due to --ignore-generated
+var skipped = StringVector{}
+
+// the canonical marker of a generated file
+var generatedMarker = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// IsGenerated reports whether the header of a source file, before the
+// package clause, marks it as generated.
+func IsGenerated(src []byte) bool {
+	for _, line := range strings.Split(string(src), "\n", -1) {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if generatedMarker.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// swigWrappers maps each SWIG interface file to the go file generated from it
+var swigWrappers = map[string]string{}
+
+// the characters windows-1252 places in 0x80-0x9f, where latin1 has control
+// characters. Unassigned bytes map to the replacement character.
+var windows1252 = [32]int{
+	0x20ac, 0xfffd, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0xfffd, 0x017d, 0xfffd,
+	0xfffd, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0xfffd, 0x017e, 0x0178,
+}
+
+// ReadSource reads a source file, converting it to UTF-8 from the encoding
+// given by --file-encoding.
+func ReadSource(fname string) ([]byte, os.Error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	switch *fileEncoding {
+	case "utf-8":
+		return content, nil
+	case "latin1", "windows-1252":
+	default:
+		return nil, os.NewError("unsupported encoding: " + *fileEncoding)
+	}
+	// every byte is a single character
+	buf := bytes.NewBuffer(nil)
+	for _, c := range content {
+		char := int(c)
+		if *fileEncoding == "windows-1252" && c >= 0x80 && c < 0xa0 {
+			char = windows1252[c-0x80]
+		}
+		buf.WriteRune(char)
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeSource converts UTF-8 source back to the encoding given by
+// --file-encoding, for writing it out again, failing on any character the
+// encoding lacks.
+func EncodeSource(src []byte) ([]byte, os.Error) {
+	if *fileEncoding == "utf-8" {
+		return src, nil
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, char := range string(src) {
+		c, ok := encodeChar(char)
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("cannot encode %q in %s",
+				string(char), *fileEncoding))
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeChar returns the byte encoding a character in latin1 or
+// windows-1252, if there is one.
+func encodeChar(char int) (byte, bool) {
+	if *fileEncoding == "windows-1252" {
+		if char == 0xfffd {
+			// the byte it was decoded from is unknown
+			return 0, false
+		}
+		for i, c := range windows1252 {
+			if c == char {
+				return byte(0x80 + i), true
+			}
+		}
+		if char >= 0x80 && char < 0xa0 {
+			return 0, false
+		}
+	}
+	return byte(char), char < 0x100
+}
+
+// FindMain finds all files which are in package 'main' and have a 'main'
+// function, and marks the package as having one if any does.
+func FindMain() {
+	// for each file in the main package
+	if pkg, ok := packages["main"]; ok {
+		for _, fname := range *pkg.files {
+			v := &MainCheckVisitor{fname: fname}
+			ast.Walk(v, parsed[fname])
+			if v.hasMain {
+				addRoot(fname)
+				pkg.hasMain = true
+			}
+		}
+		packages["main"] = pkg
+	}
+}
+
+// the environment variables describing the build environment
+var envVars = []string{"GOROOT", "GOPATH", "GOARCH", "GOOS", "CGO_ENABLED"}
+
+// PrintEnv prints each variable of the build environment which is set, so
+// that the output builds the same way wherever it is included.
+func PrintEnv() {
+	for _, name := range envVars {
+		value := os.Getenv(name)
+		if name == "GOPATH" {
+			value = strings.Join(Gopath(), ":")
+		}
+		if value != "" {
+			fmt.Fprintf(out, "%s = %s\n", name, value)
+		}
+	}
+}
+
+// PrintGoflags prints a GOFLAGS variable, which the including Makefile may
+// override, with the flags suggested by the project: -trimpath for
+// reproducible builds, -race if any test runs in parallel, and -tags with
+// the tags given by --tags.
+func PrintGoflags() {
+	flags := StringVector{"-trimpath"}
+	if HasParallelTests() {
+		flags.Push("-race")
+	}
+	if *buildTags != "" {
+		flags.Push("-tags=" + *buildTags)
+	}
+	fmt.Fprintf(out, "GOFLAGS ?= %s\n", strings.Join(flags, " "))
+}
+
+// HasParallelTests reports whether any test file calls Parallel, as on a
+// testing.T.
+func HasParallelTests() bool {
+	for fname, file := range parsed {
+		if !strings.HasSuffix(fname, "_test.go") {
+			continue
+		}
+		v := &ParallelVisitor{}
+		ast.Walk(v, file)
+		if v.found {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// ParallelVisitor
+//
+// Looks for a call of a method named Parallel.
+//
+
+type ParallelVisitor struct {
+	found bool
+}
+
+func (v *ParallelVisitor) Visit(node ast.Node) ast.Visitor {
+	if call, ok := node.(*ast.CallExpr); ok {
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok &&
+			sel.Sel.Name == "Parallel" && len(call.Args) == 0 {
+			v.found = true
+		}
+	}
+	if v.found {
+		return nil
+	}
+	return v
+}
+
+// CoalescePackages merges each package with a single file, imported by a
+// single other package, into its importer, until no more can be merged.
+func CoalescePackages() {
+	for merged := true; merged; {
+		merged = false
+		importers := map[string]StringVector{}
+		for pkgname, pkg := range packages {
+			for dep := range pkg.packages {
+				if _, ok := packages[dep]; ok {
+					importers[dep] = append(importers[dep], pkgname)
+				}
+			}
+		}
+		for pkgname, pkg := range packages {
+			if pkgname == "main" || pkg.files.Len() != 1 ||
+				len(importers[pkgname]) != 1 {
+				continue
+			}
+			parent := packages[importers[pkgname][0]]
+			parent.files.AppendVector(pkg.files)
+			parent.generators.AppendVector(pkg.generators)
+			parent.packages[pkgname] = "", false
+			parent.weights[pkgname] = 0, false
+			for dep, value := range pkg.packages {
+				parent.packages[dep] = value
+				parent.weights[dep] += pkg.weights[dep]
+			}
+			packages[pkgname] = Package{}, false
+			merged = true
+			break
+		}
+	}
+}
+
+// WarnUnusedFiles warns about each file found which did not end up in any
+// package.
+func WarnUnusedFiles() {
+	used := map[string]bool{}
+	for _, pkg := range packages {
+		for _, fname := range *pkg.files {
+			used[fname] = true
+		}
+	}
+	for _, fname := range files {
+		if !used[fname] {
+			fmt.Fprintf(os.Stderr, "warning: %s is not used\n", fname)
+		}
+	}
+}
+
+// FindSwig finds the SWIG interface files alongside each package, and adds
+// the go files to be generated from them to one of the packages in their
+// directory: that named by the %module of the interface, or else the first
+// by name. A wrapper which already exists stays in the package owning it.
+func FindSwig() {
+	// the packages with files in each directory
+	dirs := map[string]*StringVector{}
+	for pkgname, pkg := range packages {
+		for _, dir := range PackageDirs(pkg) {
+			if _, ok := dirs[dir]; !ok {
+				dirs[dir] = &StringVector{}
+			}
+			dirs[dir].Push(pkgname)
+		}
+	}
+	for dir, pkgnames := range dirs {
+		sort.Sort(pkgnames)
+		for _, iface := range SwigInterfaces(dir) {
+			wrapper := SwigWrapper(iface)
+			swigWrappers[iface] = wrapper
+			if _, ok := parsed[wrapper]; ok {
+				continue
+			}
+			owner := (*pkgnames)[0]
+			module := SwigModule(iface)
+			for _, pkgname := range *pkgnames {
+				if pkgname == module {
+					owner = pkgname
+				}
+			}
+			packages[owner].files.Push(wrapper)
+		}
+	}
+}
+
+// PrintSwig prints the rules generating go files from SWIG interface files.
+func PrintSwig() {
+	if len(swigWrappers) == 0 {
+		return
+	}
+	_, err := exec.LookPath("swig")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+	}
+	for iface, wrapper := range swigWrappers {
+		fmt.Fprintf(out, "%s: %s\n", mkPath(wrapper), mkPath(iface))
+		if err != nil {
+			fmt.Fprint(out, "\t@echo \"swig not found\" && false\n")
+		} else {
+			fmt.Fprint(out, "\tswig -go -cgo -o $@ $<\n")
+		}
+	}
+}
+
+// ExternalPackages returns the dependencies for which we don't have the
+// source.
+func ExternalPackages() StringVector {
+	// dependencies already found
+	done := map[string]bool{}
+	needed := StringVector{}
+	// for each package
+	for _, pkg := range packages {
+		for _, pkgname := range pkg.packages {
+			if _, ok := packages[pkgname]; !ok && !done[pkgname] {
+				needed.Push(pkgname)
+				done[pkgname] = true
+			}
+		}
+	}
+	return needed
+}
+
+// PrintNeeded prints out a list of external dependencies to standard output.
+func PrintNeeded(pre, ppost string) {
+	// start the list
+	fmt.Fprint(out, pre)
+	for _, pkgname := range ExternalPackages() {
+		fmt.Fprintf(out, "%s%s ", Hidden(pkgname), ppost)
+	}
+	fmt.Fprint(out, "\n")
+}
+
+// ListExternal prints the external dependencies, one per line, sorted.
+func ListExternal() {
+	external := ExternalPackages()
+	sort.Sort(&external)
+	for _, pkgname := range external {
+		fmt.Fprintln(out, pkgname)
+	}
+}
+
+// PrintNoSumCheck prints a GONOSUMCHECK variable listing the external
+// dependencies, if there are any.
+func PrintNoSumCheck() {
+	external := StringVector{}
+	for _, pkgname := range ExternalPackages() {
+		external.Push(Hidden(pkgname))
+	}
+	if external.Len() == 0 {
+		return
+	}
+	sort.Sort(&external)
+	fmt.Fprint(out, "# the external packages are known, so their sums need "+
+		"not be checked\n")
+	fmt.Fprintf(out, "GONOSUMCHECK = %s\n", strings.Join(external, ","))
+}
+
+// hidden maps each external dependency to its placeholder name
+var hidden = map[string]string{}
+
+// HideExternals names each external dependency external_dep_N, numbered in
+// the order the imports are first found, and prints the names as comments.
+func HideExternals() {
+	external := map[string]bool{}
+	for _, pkgname := range ExternalPackages() {
+		external[pkgname] = true
+	}
+	for _, fname := range files {
+		file, ok := parsed[fname]
+		if !ok {
+			continue
+		}
+		for _, spec := range file.Imports {
+			ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
+			if _, ok := hidden[ppath]; !ok && external[ppath] {
+				hidden[ppath] = fmt.Sprintf("external_dep_%d", len(hidden)+1)
+				fmt.Fprintf(out, "# %s: %s\n", hidden[ppath], ppath)
+			}
+		}
+	}
+}
+
+// Hidden returns the placeholder name of an external dependency, with
+// --hide-external-paths, or else the name itself.
+func Hidden(pkgname string) string {
+	if name, ok := hidden[pkgname]; ok {
+		return name
+	}
+	return pkgname
+}
+
+// PrintGodocLinks prints, as comments, a link to the documentation of each
+// external dependency.
+func PrintGodocLinks() {
+	for _, pkgname := range ExternalPackages() {
+		fmt.Fprintf(out, "# https://pkg.go.dev/%s\n", pkgname)
+	}
+}
+
+// PrintStubs prints a target for each external dependency which fails with
+// a clear message, rather than silently skipping the dependency.
+func PrintStubs() {
+	for _, pkgname := range ExternalPackages() {
+		if mod := ModuleOf(pkgname); mod != "" {
+			fmt.Fprintf(out, "# module: %s\n", mod)
+		}
+		fmt.Fprintf(out, "%s.a: ; @echo \"stub: %s not found\" && false\n",
+			mkRoot(Hidden(pkgname)), Hidden(pkgname))
+	}
+}
+
+// modules maps the path of each module required in go.mod to its version
+var modules = map[string]string{}
+
+// ReadModules reads the required modules from go.mod, if there is one.
+func ReadModules() {
+	content, err := ioutil.ReadFile("go.mod")
+	if err != nil {
+		return
+	}
+	inRequire := false
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "require" && len(fields) == 2 && fields[1] == "(":
+			inRequire = true
+		case fields[0] == ")":
+			inRequire = false
+		case fields[0] == "require" && len(fields) == 3:
+			modules[fields[1]] = fields[2]
+		case inRequire && len(fields) == 2:
+			modules[fields[0]] = fields[1]
+		}
+	}
+}
+
+// ModuleOf returns the module providing the named package, as path@version,
+// or an empty string if it is not provided by a required module.
+func ModuleOf(pkgname string) string {
+	module := ""
+	for mod := range modules {
+		if (pkgname == mod || strings.HasPrefix(pkgname, mod+"/")) &&
+			len(mod) > len(module) {
+			module = mod
+		}
+	}
+	if module == "" {
+		return ""
+	}
+	return module + "@" + modules[module]
+}
+
+// PrintModules prints, as comments, the module providing each external
+// dependency.
+func PrintModules() {
+	for _, pkgname := range ExternalPackages() {
+		if mod := ModuleOf(pkgname); mod != "" {
+			fmt.Fprintf(out, "# module of %s: %s\n", pkgname, mod)
+		}
+	}
+}
+
+// PackagePath returns the directory holding the source of the named package.
+// Local packages are found alongside their files, and others under the
+// GOPATH, or else in the standard library.
+func PackagePath(pkgname string) string {
+	if pkg, ok := packages[pkgname]; ok {
+		dirs := PackageDirs(pkg)
+		return dirs[0]
+	}
+	for _, dir := range Gopath() {
+		dir = path.Join(dir, "src", pkgname)
+		if finfo, err := os.Stat(dir); err == nil && finfo.IsDirectory() {
+			return dir
+		}
+	}
+	return path.Join(StdlibDir(), pkgname)
+}
+
+// the entries of the GOPATH, once read
+var gopath []string
+
+// Gopath returns the entries of the GOPATH: those in the nearest .gopath
+// file, in the current directory or above, or else those in $GOPATH.
+func Gopath() []string {
+	if gopath != nil {
+		return gopath
+	}
+	value := os.Getenv("GOPATH")
+	if dir, err := os.Getwd(); err == nil {
+		for {
+			content, err := ioutil.ReadFile(path.Join(dir, ".gopath"))
+			if err == nil {
+				value = strings.TrimSpace(string(content))
+				break
+			}
+			if dir == "/" || dir == "." {
+				break
+			}
+			dir = path.Dir(dir)
+		}
+	}
+	gopath = []string{}
+	for _, entry := range strings.Split(value, ":", -1) {
+		if entry != "" {
+			gopath = append(gopath, entry)
+		}
+	}
+	return gopath
+}
+
+// StdlibDir returns the directory holding the standard library sources:
+// that given by --stdlib-path, or else that under $GOROOT.
+func StdlibDir() string {
+	if *stdlibPath != "" {
+		return *stdlibPath
+	}
+	return path.Join(os.Getenv("GOROOT"), "src", "pkg")
+}
+
+// IsStdlibInternal reports whether the import path names an internal
+// package of the standard library: one with an element named internal,
+// found in the standard library sources.
+func IsStdlibInternal(ppath string) bool {
+	if _, ok := packages[ppath]; ok {
+		return false
+	}
+	internal := false
+	for _, elem := range strings.Split(ppath, "/", -1) {
+		if elem == "internal" {
+			internal = true
+		}
+	}
+	if !internal {
+		return false
+	}
+	finfo, err := os.Stat(path.Join(StdlibDir(), ppath))
+	return err == nil && finfo.IsDirectory()
+}
+
+// CheckStdlib prints every file importing an internal package of the
+// standard library, and exits with an error if there are any.
+func CheckStdlib() {
+	names := StringVector{}
+	for pkgname := range packages {
+		names.Push(pkgname)
+	}
+	sort.Sort(&names)
+	count := 0
+	for _, pkgname := range names {
+		pkg := packages[pkgname]
+		deps := StringVector{}
+		for _, dep := range pkg.packages {
+			if IsStdlibInternal(dep) {
+				deps.Push(dep)
+			}
+		}
+		sort.Sort(&deps)
+		for _, dep := range deps {
+			for _, fname := range *pkg.files {
+				if _, _, ok := ImportOffsets(parsed[fname], dep); ok {
+					fmt.Fprintf(out, "%s: imports %s, internal to the "+
+						"standard library\n", fname, dep)
+					count++
+				}
+			}
+		}
+	}
+	if count > 0 {
+		os.Exit(1)
+	}
+}
+
+// PrintPaths prints, as comments, the directory holding each local package
+// and external dependency.
+func PrintPaths() {
+	for pkgname := range packages {
+		fmt.Fprintf(out, "# path of %s: %s\n", pkgname, PackagePath(pkgname))
+	}
+	for _, pkgname := range ExternalPackages() {
+		fmt.Fprintf(out, "# path of %s: %s\n", pkgname, PackagePath(pkgname))
+	}
+}
+
+// PrintDeps prints out the dependency lists.
+func PrintDeps() {
+	for _, pkgname := range DepsOrder() {
+		PrintPackageDeps(pkgname)
+	}
+}
+
+// DepsOrder returns the changed packages in the order given by --sort-by,
+// with the main package last.
+func DepsOrder() StringVector {
+	order := StringVector{}
+	sizes := map[string]int{}
+	for pkgname, pkg := range packages {
+		sizes[pkgname] = pkg.files.Len()
+	}
+	// for each package
+	for _, pkgname := range SortPackages(*sortBy, Graph(), sizes) {
+		if _, ok := packages[pkgname]; ok && pkgname != "main" &&
+			IsChanged(pkgname) {
+			order.Push(pkgname)
+		}
+	}
+	// for the main package
+	if _, ok := packages["main"]; ok && IsChanged("main") {
+		order.Push("main")
+	}
+	return order
+}
+
+// WriteSplitFragments writes the dependency lists of the packages to
+// fragments named deps_001.mk, deps_002.mk and so on, each with at most the
+// number of packages given by --split-at, and a deps.mk including them all,
+// which the output includes.
+func WriteSplitFragments() {
+	limit, err := strconv.Atoi(*splitAt)
+	if err != nil || limit < 1 {
+		fmt.Fprintf(os.Stderr, "invalid --split-at: %s\n", *splitAt)
+		os.Exit(1)
+	}
+	all := out
+	master := CreateOutput("deps.mk")
+	FprintAutoNotice(master)
+	order := DepsOrder()
+	for i := 0; i < len(order); i += limit {
+		fname := fmt.Sprintf("deps_%03d.mk", i/limit+1)
+		file := CreateOutput(fname)
+		out = file
+		FprintAutoNotice(out)
+		end := i + limit
+		if end > len(order) {
+			end = len(order)
+		}
+		for _, pkgname := range order[i:end] {
+			PrintPackageDeps(pkgname)
+		}
+		file.Close()
+		fmt.Fprintf(master, "include %s\n", fname)
+	}
+	master.Close()
+	out = all
+	fmt.Fprint(out, "include deps.mk\n")
+}
+
+// CreateOutput creates the named output file, along with any missing
+// directories.
+func CreateOutput(fname string) *os.File {
+	if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	file, err := os.Create(fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	return file
+}
+
+// WritePackageFragments writes the dependency lists of each changed package
+// to a fragment of its own in the directory given by --output-dir, and
+// includes each fragment in the output, in the order given by --sort-by.
+func WritePackageFragments() {
+	all := out
+	for _, pkgname := range DepsOrder() {
+		fname := path.Join(*outputDir, pkgname+".mk")
+		file := CreateOutput(fname)
+		out = file
+		FprintAutoNotice(out)
+		PrintPackageDeps(pkgname)
+		file.Close()
+		out = all
+		fmt.Fprintf(out, "include %s\n", fname)
+	}
+}
+
+// IsChanged reports whether any file of the named package was modified
+// since the time given by --newer-than. Without it, every package counts as
+// changed.
+func IsChanged(pkgname string) bool {
+	if *newerThan == "" {
+		return true
+	}
+	for _, fname := range *packages[pkgname].files {
+		finfo, err := os.Stat(fname)
+		if err == nil && finfo.Mtime_ns/1e9 > since {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintPackageDeps prints out the dependency lists of a single package.
+func PrintPackageDeps(pkgname string) {
+	pkg := packages[pkgname]
+	implied := map[string]bool{}
+	if *compressDeps {
+		implied = Implied(pkg)
+	}
+	if IsLarge(pkgname) {
+		fmt.Fprintf(out, "# WARNING: large package (%d files)\n",
+			pkg.files.Len())
+	}
+	if pkgname != "main" {
+		// start the list
+		fmt.Fprintf(out, "%s.a: ", mkRoot(pkgname))
+		// print all the files
+		for _, fname := range *pkg.files {
+			if !IsConditional(fname) {
+				fmt.Fprintf(out, "%s ", mkPath(fname))
+			}
+		}
+		// print all packages for which we have the source
+		// exception: if -n or --stub-missing was supplied, print
+		// all packages
+		for _, pkgname := range pkg.packages {
+			_, ok := packages[pkgname]
+			if implied[pkgname] {
+				continue
+			}
+			if ok || *showNeeded || *stubMissing {
+				fmt.Fprintf(out, "%s.a ", mkRoot(Hidden(pkgname)))
+			}
+		}
+		fmt.Fprintf(out, "\n")
+		PrintConditionals(mkRoot(pkgname)+".a", *pkg.files)
+		PrintCompile(pkgname, *pkg.files)
+		return
+	}
+	// for the main package
+	apps := MainApps()
+	for _, app := range apps {
+		fmt.Fprintf(out, "%s: %s\n", app.name, mkObj(app.name))
+	}
+	// for every application
+	for _, app := range apps {
+		// dependencies already displayed
+		done := map[string]bool{}
+		// print the files
+		fmt.Fprintf(out, "%s: ", mkObj(app.name))
+		for _, fname := range app.files {
+			if !IsConditional(fname) {
+				fmt.Fprintf(out, "%s ", mkPath(fname))
+			}
+		}
+		// print all packages for which we have the source, or,
+		// if -n or --stub-missing was supplied, print all
+		for _, pkgname := range pkg.packages {
+			_, ok := packages[pkgname]
+			if implied[pkgname] {
+				continue
+			}
+			if ok || ((*showNeeded || *stubMissing) &&
+				!done[pkgname]) {
+				fmt.Fprintf(out, "%s.a ", mkRoot(Hidden(pkgname)))
+				done[pkgname] = true
+			}
+		}
+		fmt.Fprintf(out, "\n")
+		PrintConditionals(mkObj(app.name), app.files)
+		PrintCompile(pkgname, app.files)
+	}
+}
+
+// the file giving the compiler flags of packages, by name
+const compileFlagsFile = "compiler-flags.toml"
+
+// the annotation giving the compiler flags of the package of a file
+const compileFlagsAnnotation = "// +gcflags "
+
+// compileFlags maps package names to the flags read from compileFlagsFile
+var compileFlags map[string]string
+
+// CompileFlags returns the compiler flags of the package, from
+// compileFlagsFile and from the "// +gcflags" lines above the package
+// clause of the given files.
+func CompileFlags(pkgname string, fnames []string) StringVector {
+	if compileFlags == nil {
+		compileFlags, _ = ReadConfig(compileFlagsFile)
+	}
+	flags := StringVector{}
+	if value, ok := compileFlags[pkgname]; ok {
+		flags.AppendVector(Fields(strings.Trim(value, "\"")))
+	}
+	for _, fname := range fnames {
+		file, ok := parsed[fname]
+		if !ok {
+			continue
+		}
+		for _, group := range file.Comments {
+			if group.Pos() > file.Package {
+				break
+			}
+			for _, comment := range group.List {
+				if strings.HasPrefix(comment.Text,
+					compileFlagsAnnotation) {
+					flags.AppendVector(Fields(
+						comment.Text[len(compileFlagsAnnotation):]))
+				}
+			}
+		}
+	}
+	return flags
+}
+
+// Fields returns the words of the string as a StringVector.
+func Fields(str string) *StringVector {
+	words := StringVector(strings.Fields(str))
+	return &words
+}
+
+// PrintCompile prints, for --emit-compile-flags, the recipe compiling the
+// go files among the prerequisites of the target with the compiler flags of
+// the package.
+func PrintCompile(pkgname string, fnames []string) {
+	if !*emitCompileFlags {
+		return
+	}
+	flags := CompileFlags(pkgname, fnames)
+	// the archives of the local packages imported are found below the root
+	flags.Insert(0, "-I "+mkPath(path.Join(*srcRoot, ".")))
+	if *objDir != "" {
+		flags.Insert(1, "-I "+mkPath(*objDir))
+	}
+	flags.Insert(0, "-p "+pkgname)
+	fmt.Fprintf(out, "\tgo tool compile %s -o $@ ${filter %%.go,$^}\n",
+		strings.Join(flags, " "))
+}
+
+// IsConditional reports whether the file is only built on some platforms,
+// and so, with --emit-makefile-conditionals, listed within an ifeq block.
+func IsConditional(fname string) bool {
+	if !*emitConditionals {
+		return false
+	}
+	goos, goarch := FileTarget(fname)
+	return goos != "" || goarch != ""
+}
+
+// PrintConditionals adds the platform-specific files among those given to
+// the prerequisites of the target, each within ifeq blocks testing GOOS
+// and GOARCH.
+func PrintConditionals(target string, fnames []string) {
+	for _, fname := range fnames {
+		if !IsConditional(fname) {
+			continue
+		}
+		goos, goarch := FileTarget(fname)
+		if goos != "" {
+			fmt.Fprintf(out, "ifeq ($(GOOS),%s)\n", goos)
+		}
+		if goarch != "" {
+			fmt.Fprintf(out, "ifeq ($(GOARCH),%s)\n", goarch)
+		}
+		fmt.Fprintf(out, "%s: %s\n", target, mkPath(fname))
+		if goarch != "" {
+			fmt.Fprint(out, "endif\n")
+		}
+		if goos != "" {
+			fmt.Fprint(out, "endif\n")
+		}
+	}
+}
+
+// Implied returns the packages reachable through the imports of the
+// package's direct imports, and so implied as prerequisites by them.
+func Implied(pkg Package) map[string]bool {
+	graph := Graph()
+	implied := map[string]bool{}
+	var visit func(node string)
+	visit = func(node string) {
+		for _, dep := range graph[node] {
+			if !implied[dep] {
+				implied[dep] = true
+				visit(dep)
+			}
+		}
+	}
+	for dep := range pkg.packages {
+		visit(dep)
+	}
+	return implied
+}
+
+// Linker returns the linker for the architecture given by --arch, or else
+// that of the go tool.
+func Linker() string {
+	if *arch == "" {
+		return "go tool link"
+	}
+	return objExt + "l"
+}
+
+// PrintLink prints a rule linking each executable from its object, once it
+// and every local package it needs, directly or not, are up to date.
+func PrintLink() {
+	if _, ok := packages["main"]; !ok {
+		return
+	}
+	graph := Graph()
+	// the archives are found where PrintCompile looks for them
+	dirs := "-L " + mkPath(path.Join(*srcRoot, "."))
+	if *objDir != "" {
+		dirs += " -L " + mkPath(*objDir)
+	}
+	// make gives LD a default of its own, which is not a go linker
+	fmt.Fprint(out, "ifeq ($(origin LD),default)\n")
+	fmt.Fprintf(out, "LD = %s\n", Linker())
+	fmt.Fprint(out, "endif\n")
+	for _, app := range MainApps() {
+		needed := StringVector{}
+		done := map[string]bool{}
+		var visit func(deps []string)
+		visit = func(deps []string) {
+			for _, dep := range deps {
+				if _, ok := packages[dep]; ok && !done[dep] {
+					done[dep] = true
+					needed.Push(mkRoot(dep) + ".a")
+					visit(graph[dep])
+				}
+			}
+		}
+		visit(FileImports(app.files))
+		sort.Sort(&needed)
+		fmt.Fprintf(out, "%s: %s %s\n", app.name, mkObj(app.name),
+			strings.Join(needed, " "))
+		fmt.Fprintf(out, "\t${LD} %s -o $@ $<\n", dirs)
+	}
+}
+
+// FileImports returns the imports of the given files, sorted.
+func FileImports(fnames []string) StringVector {
+	imports := Package{packages: map[string]string{},
+		weights: map[string]int{}}
+	for _, fname := range fnames {
+		if file, ok := parsed[fname]; ok {
+			ast.Walk(ImportVisitor{imports}, file)
+		}
+	}
+	deps := StringVector{}
+	for dep := range imports.packages {
+		deps.Push(dep)
+	}
+	sort.Sort(&deps)
+	return deps
+}
+
+// an executable built from the main package
+type App struct {
+	name  string
+	files StringVector // the files it is built from
+}
+
+// MainApps returns the executables of the main package. Each application
+// root is built, along with all files of the package which are not roots,
+// into an executable of its own. With --detect-main-packages, each
+// subdirectory holding a root instead makes a single executable, named after
+// the directory, from the files within it.
+func MainApps() []App {
+	apps := []App{}
+	main, ok := packages["main"]
+	if !ok {
+		return apps
+	}
+	// the subdirectories making executables of their own
+	dirApps := map[string]bool{}
+	if *detectMains {
+		for fname := range roots {
+			if dir := path.Dir(fname); dir != "." {
+				dirApps[dir] = true
+			}
+		}
+	}
+	common := StringVector{}
+	for _, fname := range *main.files {
+		if _, ok := roots[fname]; !ok && !dirApps[path.Dir(fname)] {
+			common.Push(fname)
+		}
+	}
+	for _, fname := range *main.files {
+		if app, ok := roots[fname]; ok && !dirApps[path.Dir(fname)] {
+			files := StringVector{fname}
+			files.AppendVector(&common)
+			apps = append(apps, App{app, files})
+		}
+	}
+	dirs := StringVector{}
+	for dir := range dirApps {
+		dirs.Push(dir)
+	}
+	sort.Sort(&dirs)
+	for _, dir := range dirs {
+		files := StringVector{}
+		for _, fname := range *main.files {
+			if path.Dir(fname) == dir {
+				files.Push(fname)
+			}
+		}
+		apps = append(apps, App{path.Base(dir), files})
+	}
+	return apps
+}
+
+// the file stamped when go generate has run
+const generateStamp = ".generate.stamp"
+
+// PrintGenerate prints the generate target, which runs go generate on every
+// package with at least one //go:generate directive.
+func PrintGenerate() {
+	// the generating files, and the directories holding them
+	gens := StringVector{}
+	dirs := StringVector{}
+	done := map[string]bool{}
+	for _, pkg := range packages {
+		for _, fname := range *pkg.generators {
+			gens.Push(fname)
+			dir := path.Dir(fname)
+			if !done[dir] {
+				dirs.Push(dir)
+				done[dir] = true
+			}
+		}
+	}
+	if gens.Len() == 0 {
+		return
+	}
+	sort.Sort(&gens)
+	sort.Sort(&dirs)
+	Phony("generate")
+	fmt.Fprintf(out, "generate: %s\n", generateStamp)
+	fmt.Fprintf(out, "%s: ", generateStamp)
+	for _, fname := range gens {
+		fmt.Fprintf(out, "%s ", mkPath(fname))
+	}
+	fmt.Fprint(out, "\n")
+	for _, dir := range dirs {
+		// go generate takes relative directories as ./dir
+		dir = mkPath(dir)
+		if !path.IsAbs(dir) {
+			dir = "./" + dir
+		}
+		fmt.Fprintf(out, "\tgo generate %s\n", dir)
+	}
+	// stamp it so it only reruns when a generating file changes
+	fmt.Fprint(out, "\t@touch $@\n")
+}
+
+// PackageDirs returns the directories holding the files of a package.
+func PackageDirs(pkg Package) StringVector {
+	dirs := StringVector{}
+	done := map[string]bool{}
+	for _, fname := range *pkg.files {
+		dir := path.Dir(fname)
+		if !done[dir] {
+			dirs.Push(dir)
+			done[dir] = true
+		}
+	}
+	return dirs
+}
+
+// PackageTargets returns the targets which build the named package: its
+// archive, or, for package main, each of its executables.
+func PackageTargets(pkgname string) StringVector {
+	targets := StringVector{}
+	if pkgname != "main" {
+		targets.Push(mkRoot(pkgname) + ".a")
+		return targets
+	}
+	for _, app := range MainApps() {
+		targets.Push(app.name)
+	}
+	return targets
+}
+
+// the command running tests; the race detector needs cgo
+const raceTest = "CGO_ENABLED=1 go test -race"
+
+// goTest returns the command test targets run tests with.
+func goTest() string {
+	if *emitRace {
+		return raceTest
+	}
+	return "go test"
+}
+
+// PrintTestRace prints a test-race target, which runs all tests with the
+// race detector once every package is up to date.
+func PrintTestRace() {
+	Phony("test-race")
+	fmt.Fprint(out, "test-race: ")
+	for _, pkgname := range SortedNodes(Graph()) {
+		if _, ok := packages[pkgname]; !ok {
+			continue
+		}
+		for _, target := range PackageTargets(pkgname) {
+			fmt.Fprintf(out, "%s ", target)
+		}
+	}
+	fmt.Fprint(out, "\n")
+	fmt.Fprintf(out, "\t%s ./...\n", raceTest)
+}
+
+// TestPackages returns the names of the packages with tests, sorted.
+func TestPackages() StringVector {
+	names := StringVector{}
+	for pkgname, pkg := range packages {
+		for _, fname := range *pkg.files {
+			if strings.HasSuffix(fname, "_test.go") {
+				names.Push(pkgname)
+				break
+			}
+		}
+	}
+	sort.Sort(&names)
+	return names
+}
+
+// PrintBenchmark prints a bench target running the benchmarks of every
+// package with tests, and a bench-cpu target also profiling each package's
+// benchmarks into cpu-<pkgname>.out. Both depend on the packages they run.
+func PrintBenchmark() {
+	tested := TestPackages()
+	prereqs := ""
+	for _, pkgname := range tested {
+		for _, target := range PackageTargets(pkgname) {
+			prereqs += target + " "
+		}
+	}
+	Phony("bench")
+	fmt.Fprintf(out, "bench: %s\n", prereqs)
+	fmt.Fprint(out, "\tgo test -bench=. -benchmem")
+	for _, pkgname := range tested {
+		for _, dir := range PackageDirs(packages[pkgname]) {
+			fmt.Fprintf(out, " ./%s", mkPath(dir))
+		}
+	}
+	fmt.Fprint(out, "\n")
+	// a profile can only be taken of one package at a time
+	Phony("bench-cpu")
+	fmt.Fprintf(out, "bench-cpu: %s\n", prereqs)
+	for _, pkgname := range tested {
+		for _, dir := range PackageDirs(packages[pkgname]) {
+			fmt.Fprintf(out, "\tgo test -bench=. -benchmem "+
+				"-cpuprofile=cpu-%s.out ./%s\n", pkgname, mkPath(dir))
+		}
+	}
+}
+
+// PrintCoverage prints a cover-<pkgname> target for each package, and a
+// coverage-report target covering all of them. Every target depends on the
+// packages it tests, so stale packages are rebuilt first.
+func PrintCoverage() {
+	all := StringVector{}
+	for _, pkgname := range SortedNodes(Graph()) {
+		pkg, ok := packages[pkgname]
+		if !ok {
+			continue
+		}
+		Phony("cover-" + pkgname)
+		fmt.Fprintf(out, "cover-%s: ", pkgname)
+		for _, target := range PackageTargets(pkgname) {
+			fmt.Fprintf(out, "%s ", target)
+			all.Push(target)
+		}
+		fmt.Fprint(out, "\n")
+		for _, dir := range PackageDirs(pkg) {
+			fmt.Fprintf(out, "\t%s -coverprofile=coverage.out ./%s\n",
+				goTest(), mkPath(dir))
+		}
+	}
+	Phony("coverage-report")
+	fmt.Fprint(out, "coverage-report: ")
+	for _, target := range all {
+		fmt.Fprintf(out, "%s ", target)
+	}
+	fmt.Fprint(out, "\n")
+	fmt.Fprintf(out, "\t%s -coverprofile=coverage.out ./...\n", goTest())
+	fmt.Fprint(out, "\tgo tool cover -html=coverage.out\n")
+}
+
+// PrintCoverageThreshold prints a test target running all tests once every
+// package is up to date, and failing if the total coverage is below that
+// given by --coverage-threshold.
+func PrintCoverageThreshold() {
+	if _, err := strconv.Atof64(*coverageThreshold); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	Phony("test")
+	fmt.Fprint(out, "test: ")
+	for _, pkgname := range SortedNodes(Graph()) {
+		if _, ok := packages[pkgname]; !ok {
+			continue
+		}
+		for _, target := range PackageTargets(pkgname) {
+			fmt.Fprintf(out, "%s ", target)
+		}
+	}
+	fmt.Fprint(out, "\n")
+	fmt.Fprintf(out, "\t%s -coverprofile=cover.out ./...\n", goTest())
+	fmt.Fprintf(out, "\t@go tool cover -func=cover.out | awk '/^total:/ { "+
+		"sub(\"%%\", \"\", $$3); if ($$3 + 0 < %s) { "+
+		"print \"coverage \" $$3 \"%% is below %s%%\"; exit 1 } }'\n",
+		*coverageThreshold, *coverageThreshold)
+}
+
+// PrintVet prints a vet-<pkgname> target running go vet on each package once
+// it is up to date, and a vet target aggregating them.
+func PrintVet() {
+	Phony("vet")
+	names := StringVector{}
+	for _, pkgname := range SortedNodes(Graph()) {
+		if _, ok := packages[pkgname]; ok {
+			names.Push(pkgname)
+		}
+	}
+	fmt.Fprint(out, "vet: ")
+	for _, pkgname := range names {
+		fmt.Fprintf(out, "vet-%s ", pkgname)
+	}
+	fmt.Fprint(out, "\n")
+	for _, pkgname := range names {
+		pkg := packages[pkgname]
+		Phony("vet-" + pkgname)
+		fmt.Fprintf(out, "vet-%s: ", pkgname)
+		for _, target := range PackageTargets(pkgname) {
+			fmt.Fprintf(out, "%s ", target)
+		}
+		fmt.Fprint(out, "\n")
+		for _, dir := range PackageDirs(pkg) {
+			fmt.Fprintf(out, "\tgo vet ./%s\n", mkPath(dir))
+		}
+	}
+}
+
+// PrintDotWeight prints the dependency graph in DOT format, weighting each
+// edge by the number of files in the importing package which import the
+// dependency.
+func PrintDotWeight() {
+	fmt.Fprint(out, "digraph godep {\n")
+	for pkgname, pkg := range packages {
+		for dep, weight := range pkg.weights {
+			fmt.Fprintf(out, "\t\"%s\" -> \"%s\" [weight=%d, penwidth=%d];\n",
+				pkgname, dep, weight, weight)
+		}
+	}
+	fmt.Fprint(out, "}\n")
+}
+
+// PrintStaticcheck prints a staticcheck target, and a lint target running it
+// along with the vet targets, if any. If staticcheck is not installed, the
+// target says how to install it, and fails.
+func PrintStaticcheck() {
+	Phony("staticcheck")
+	fmt.Fprint(out, "staticcheck:\n")
+	if _, err := exec.LookPath("staticcheck"); err != nil {
+		fmt.Fprint(out, "\t@echo \"staticcheck not found; install it with "+
+			"go install honnef.co/go/tools/cmd/staticcheck@latest\"\n")
+		fmt.Fprint(out, "\t@exit 1\n")
+	} else {
+		fmt.Fprint(out, "\tstaticcheck ./...\n")
+	}
+	Phony("lint")
+	fmt.Fprint(out, "lint: staticcheck ")
+	if *emitVet {
+		fmt.Fprint(out, "vet ")
+	}
+	fmt.Fprint(out, "\n")
+}
+
+func HandleFile(fname string, file *ast.File) {
+	parsed[fname] = file
+	pkgname := file.Name.Name
+	if pkg, ok := packages[pkgname]; ok {
+		pkg.files.Push(fname)
+	} else {
+		packages[pkgname] = Package{
+			files:      &StringVector{},
+			packages:   map[string]string{},
+			hasMain:    false,
+			generators: &StringVector{},
+			weights:    map[string]int{},
+		}
+		packages[pkgname].files.Push(fname)
+	}
+	ast.Walk(&ImportVisitor{packages[pkgname]}, file)
+	if HasGenerate(file) {
+		packages[pkgname].generators.Push(fname)
+	}
+}
+
+// HasGenerate reports whether the file contains a //go:generate directive.
+func HasGenerate(file *ast.File) bool {
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			if strings.HasPrefix(comment.Text, "//go:generate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// ImportVisitor
+//
+// Finds a lists all imports for the scanned file, except those annotated
+// with //godep:ignore.
+//
+
+type ImportVisitor struct {
+	pkg Package
+}
+
+func (v ImportVisitor) Visit(node ast.Node) ast.Visitor {
+	// an ungrouped import carries its annotation on the declaration
+	if decl, ok := node.(*ast.GenDecl); ok && decl.Tok == token.IMPORT &&
+		!decl.Lparen.IsValid() && IsIgnored(decl.Doc) {
+		return nil
+	}
+	// check the type of the node
+	if spec, ok := node.(*ast.ImportSpec); ok {
+		if IsIgnored(spec.Doc) {
+			return v
+		}
+		ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
+		if _, ok = v.pkg.packages[ppath]; !ok {
+			v.pkg.packages[ppath] = ppath
+		}
+		v.pkg.weights[ppath]++
+	}
+	return v
+}
+
+// IsIgnored reports whether a comment group holds a //godep:ignore
+// annotation.
+func IsIgnored(doc *ast.CommentGroup) bool {
+	return HasAnnotation(doc, "//godep:ignore")
+}
+
+// HasAnnotation reports whether a comment group holds the given annotation
+// on a line of its own.
+func HasAnnotation(doc *ast.CommentGroup, annotation string) bool {
+	if doc == nil {
+		return false
+	}
+	for _, comment := range doc.List {
+		if strings.TrimSpace(comment.Text) == annotation {
+			return true
+		}
+	}
+	return false
+}
+
+// addRoot records the file as the root of an executable, named after it.
+func addRoot(filename string) {
+	fparts := strings.Split(filename, ".", -1)
+	basename := fparts[0]
+	roots[filename] = basename
+}
+
+// CopyFile copies the file src to dst, creating any missing directories.
+func CopyFile(src, dst string) os.Error {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, content, 0644)
+}
+
+// Snapshot copies the sources of every local package into the directory
+// given by --output, preserving their layout, for building offline.
+func Snapshot() {
+	// only files below the current directory keep their layout within it
+	for _, pkg := range packages {
+		for _, fname := range *pkg.files {
+			clean := path.Clean(fname)
+			if path.IsAbs(clean) || clean == ".." ||
+				strings.HasPrefix(clean, "../") {
+				fmt.Fprintf(os.Stderr, "cannot snapshot %s: not below the "+
+					"current directory\n", fname)
+				os.Exit(1)
+			}
+		}
+	}
+	for _, pkg := range packages {
+		for _, fname := range *pkg.files {
+			err := CopyFile(fname, path.Join(*snapshotDir, fname))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// Restore copies a snapshot from the directory given by --from into the
+// first entry of the GOPATH.
+func Restore(args []string) {
+	if len(Gopath()) == 0 {
+		fmt.Fprint(os.Stderr, "GOPATH is not set\n")
+		os.Exit(1)
+	}
+	filepath.Walk(*restoreDir, &RestoreVisitor{path.Join(Gopath()[0], "src")},
+		nil)
+}
+
+//
+// RestoreVisitor
+//
+// Copies each file of a snapshot into place.
+//
+
+type RestoreVisitor struct {
+	dest string
+}
+
+func (v *RestoreVisitor) VisitDir(path string, finfo *os.FileInfo) bool {
+	return true
+}
+
+func (v *RestoreVisitor) VisitFile(fpath string, finfo *os.FileInfo) {
+	rel := fpath[len(*restoreDir):]
+	if err := CopyFile(fpath, path.Join(v.dest, rel)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+//
+// FormatFragment
+//
+// Canonicalizes a makefile fragment, as gofmt does for go sources.
+//
+
+// a line of a makefile fragment, along with the recipe lines following it
+type Stanza struct {
+	head   string
+	kind   int // one of the stanza kinds below
+	index  int // position in the original fragment
+	recipe StringVector
+}
+
+// stanza kinds, in the order they are printed. Fixed stanzas, conditionals
+// and includes, are never moved: only the stanzas between them are sorted.
+const (
+	commentStanza = iota
+	variableStanza
+	ruleStanza
+	fixedStanza
+)
+
+// directives opening a conditional block, which lasts until the matching endif
+var conditionalDirectives = map[string]bool{
+	"ifeq": true, "ifneq": true, "ifdef": true, "ifndef": true,
+}
+
+// directives including another makefile
+var includeDirectives = map[string]bool{
+	"include": true, "-include": true, "sinclude": true,
+}
+
+// suffixes of the variables holding file or package lists, whose values are
+// sorted; all other values are left as written
+var listSuffixes = []string{"FILES", "PKGS", "PACKAGES", "DEPS", "OBJS"}
+
+type Stanzas []Stanza
+
+func (s Stanzas) Len() int      { return len(s) }
+func (s Stanzas) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// comments keep their original order; everything else is sorted
+func (s Stanzas) Less(i, j int) bool {
+	if s[i].kind != s[j].kind {
+		return s[i].kind < s[j].kind
+	}
+	if s[i].kind == commentStanza {
+		return s[i].index < s[j].index
+	}
+	return s[i].head < s[j].head
+}
+
+// FormatFragment reads a makefile fragment from the named file, or standard
+// input if none is given, and prints it with every file and package list
+// sorted and deduplicated, and whitespace normalized. Conditional blocks and
+// includes are printed as written, in their original place.
+func FormatFragment(args []string) {
+	var content []byte
+	var err os.Error
+	if len(args) > 0 {
+		content, err = ioutil.ReadFile(args[0])
+	} else {
+		content, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	// join continued lines
+	text := strings.Replace(string(content), "\\\n", " ", -1)
+	stanzas := Stanzas{}
+	depth := 0 // of the conditional block being read
+	for _, line := range strings.Split(text, "\n", -1) {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			continue
+		}
+		directive := ""
+		if fields := strings.Fields(line); line[0] != '\t' {
+			directive = fields[0]
+		}
+		if depth > 0 {
+			// kept as written, along with the directive opening the block
+			last := &stanzas[len(stanzas)-1]
+			last.recipe.Push(line)
+			if conditionalDirectives[directive] {
+				depth++
+			} else if directive == "endif" {
+				depth--
+			}
+			continue
+		}
+		if line[0] == '\t' && len(stanzas) > 0 {
+			last := &stanzas[len(stanzas)-1]
+			last.recipe.Push(line)
+			continue
+		}
+		head, kind := line, fixedStanza
+		if conditionalDirectives[directive] {
+			depth = 1
+		} else if !includeDirectives[directive] && directive != "else" &&
+			directive != "endif" {
+			head, kind = FormatLine(line)
+		}
+		stanzas = append(stanzas, Stanza{head: head, kind: kind,
+			index: len(stanzas)})
+	}
+	// sort each run of stanzas between two fixed ones
+	start := 0
+	for i := range stanzas {
+		if stanzas[i].kind == fixedStanza {
+			sort.Sort(stanzas[start:i])
+			start = i + 1
+		}
+	}
+	sort.Sort(stanzas[start:])
+	for _, stanza := range stanzas {
+		fmt.Fprintln(out, stanza.head)
+		for _, line := range stanza.recipe {
+			fmt.Fprintln(out, line)
+		}
+	}
+}
+
+// FormatLine canonicalizes a single line of a makefile fragment, returning
+// it along with its kind.
+func FormatLine(line string) (string, int) {
+	if strings.HasPrefix(line, "#") {
+		return line, commentStanza
+	}
+	colon := strings.Index(line, ":")
+	equals := strings.Index(line, "=")
+	// an assignment, possibly with :=, +=, etc.
+	if equals >= 0 && (colon < 0 || colon >= equals-1) {
+		name := strings.TrimSpace(line[:equals])
+		op := "="
+		if n := len(name); n > 0 && strings.IndexAny(name[n-1:], ":+?") == 0 {
+			name, op = strings.TrimSpace(name[:n-1]), name[n-1:]+"="
+		}
+		value := strings.Join(strings.Fields(line[equals+1:]), " ")
+		if IsListVariable(name) {
+			value = SortWords(value)
+		}
+		return name + " " + op + " " + value, variableStanza
+	}
+	if colon < 0 {
+		return strings.Join(strings.Fields(line), " "), ruleStanza
+	}
+	targets := strings.Join(strings.Fields(line[:colon]), " ")
+	prereqs, recipe := line[colon+1:], ""
+	if semi := strings.Index(prereqs, ";"); semi >= 0 {
+		prereqs, recipe = prereqs[:semi], prereqs[semi:]
+	}
+	formatted := targets + ":"
+	if words := SortWords(prereqs); words != "" {
+		formatted += " " + words
+	}
+	if recipe != "" {
+		formatted += " " + recipe
+	}
+	return formatted, ruleStanza
+}
+
+// IsListVariable reports whether the named variable holds a list of files or
+// packages.
+func IsListVariable(name string) bool {
+	for _, suffix := range listSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SortWords returns the whitespace-separated words of a list, sorted and
+// without duplicates.
+func SortWords(list string) string {
+	words := StringVector{}
+	done := map[string]bool{}
+	for _, word := range strings.Fields(list) {
+		if !done[word] {
+			words.Push(word)
+			done[word] = true
+		}
+	}
+	sort.Sort(&words)
+	return strings.Join(words, " ")
+}
+
+//
+// Completions
+//
+// Shell completion scripts. Flags are completed from the output of
+// godep --help, so that they never go out of date.
+//
+
+const bashCompletion = `# bash completion for godep; install with
+#   godep completions bash > /etc/bash_completion.d/godep
+_godep() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	case "$cur" in
+	-*)
+		COMPREPLY=($(compgen -W "$(godep --help 2>&1 |
+			grep -o -e '--[a-z-]*')" -- "$cur"))
+		return
+		;;
+	esac
+	if [ $COMP_CWORD -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	fi
+	case " %s " in
+	*" ${COMP_WORDS[1]} "*)
+		COMPREPLY+=($(compgen -W "$(godep completions packages)" -- "$cur"))
+		return
+		;;
+	esac
+	COMPREPLY+=($(compgen -f -X '!*.go' -- "$cur"))
+}
+complete -o plusdirs -F _godep godep
+`
+
+const zshCompletion = `# zsh completion for godep; install with
+#   godep completions zsh > ~/.zsh/godep.zsh
+# and source it from ~/.zshrc
+autoload -U +X bashcompinit && bashcompinit
+`
+
+const fishCompletion = `# fish completion for godep; install with
+#   godep completions fish > ~/.config/fish/completions/godep.fish
+complete -c godep -n '__fish_is_first_token' -a '%s'
+complete -c godep -n 'string match -q -- "-*" (commandline -ct)' \
+	-a '(godep --help 2>&1 | string match -ar -- "--[a-z-]+")'
+complete -c godep -n '__fish_seen_subcommand_from %s' \
+	-a '(godep completions packages)'
+`
+
+// Completions prints the completion script for the given shell, one of bash,
+// zsh or fish. Given packages, it instead lists the packages found below the
+// current directory, for use by the scripts.
+func Completions(args []string) {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, "usage: godep completions bash|zsh|fish\n")
+		os.Exit(1)
+	}
+	names := StringVector{}
+	for name := range commands {
+		names.Push(name)
+	}
+	for name := range tools {
+		names.Push(name)
+	}
+	sort.Sort(&names)
+	cmds := strings.Join(names, " ")
+	pkgCmds := strings.Join(packageCommands, " ")
+	switch args[0] {
+	case "bash":
+		fmt.Fprintf(out, bashCompletion, cmds, pkgCmds)
+	case "zsh":
+		fmt.Fprint(out, zshCompletion)
+		fmt.Fprintf(out, bashCompletion, cmds, pkgCmds)
+	case "fish":
+		fmt.Fprintf(out, fishCompletion, cmds, pkgCmds)
+	case "packages":
+		Analyze(nil)
+		for _, pkgname := range SortedNodes(Graph()) {
+			if _, ok := packages[pkgname]; ok {
+				fmt.Fprintln(out, pkgname)
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown shell: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+//
+// Graph metrics
+//
+
+// Graph returns the import graph: each local package and external
+// dependency, mapped to the packages it imports, in sorted order.
+func Graph() map[string][]string {
+	graph := map[string][]string{}
+	for pkgname, pkg := range packages {
+		deps := StringVector{}
+		for dep := range pkg.packages {
+			deps.Push(dep)
+		}
+		sort.Sort(&deps)
+		graph[pkgname] = deps
+		for _, dep := range deps {
+			if _, ok := graph[dep]; !ok {
+				graph[dep] = nil
+			}
+		}
+	}
+	return graph
+}
+
+// SortedNodes returns the packages of a graph in sorted order.
+func SortedNodes(graph map[string][]string) StringVector {
+	nodes := StringVector{}
+	for node := range graph {
+		nodes.Push(node)
+	}
+	sort.Sort(&nodes)
+	return nodes
+}
+
+// the number of packages to list by betweenness centrality
+const topBetweenness = 5
+
+// PrintPackages prints the name of each package, one per line, along with
+// its files, indented, if --with-files was given.
+func PrintPackages() {
+	names := StringVector{}
+	for pkgname := range packages {
+		names.Push(pkgname)
+	}
+	sort.Sort(&names)
+	for _, pkgname := range names {
+		fmt.Fprintln(out, pkgname)
+		if *withFiles {
+			for _, fname := range *packages[pkgname].files {
+				fmt.Fprintf(out, "\t%s\n", fname)
+			}
+		}
+	}
+}
+
+// TargetPackage returns the package, or executable of package main, built
+// by the named target, with any root, object directory, import prefix and
+// extension removed.
+func TargetPackage(target string) string {
+	exts := ObjectExts()
+	exts["${O}"] = true
+	exts["a"] = true
+	if ext := path.Ext(target); ext != "" && exts[ext[1:]] {
+		target = trimExt(target)
+	}
+	for _, dir := range []string{*objDir, *srcRoot} {
+		if dir != "" && strings.HasPrefix(target, dir+"/") {
+			target = target[len(dir)+1:]
+		}
+	}
+	// local packages are prefixed by mkRoot
+	prefix := *importPrefix
+	if prefix != "" && strings.HasPrefix(target, prefix+"/") {
+		if _, ok := packages[target[len(prefix)+1:]]; ok {
+			target = target[len(prefix)+1:]
+		}
+	}
+	return target
+}
+
+// ExplainTarget analyzes all go files below the current directory, and
+// prints why the given target appears in the output: whether it is built
+// here, and which files import it.
+func ExplainTarget(args []string) {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, "usage: godep explain-target TARGET\n")
+		os.Exit(1)
+	}
+	Analyze(nil)
+	pkgname := TargetPackage(args[0])
+	for _, app := range MainApps() {
+		if app.name == pkgname {
+			fmt.Fprintf(out, "%s: executable of package main, built from %s\n",
+				pkgname, strings.Join(app.files, " "))
+			return
+		}
+	}
+	names := StringVector{}
+	for name, importer := range packages {
+		if _, ok := importer.packages[pkgname]; ok {
+			names.Push(name)
+		}
+	}
+	pkg, ok := packages[pkgname]
+	switch {
+	case ok:
+		fmt.Fprintf(out, "%s: internal package, built from %s\n", pkgname,
+			strings.Join(*pkg.files, " "))
+	case names.Len() == 0:
+		// neither built here nor imported
+		fmt.Fprintf(os.Stderr, "no such target: %s\n", args[0])
+		os.Exit(1)
+	case *stubMissing || *showNeeded:
+		fmt.Fprintf(out, "%s: external package\n", pkgname)
+	default:
+		fmt.Fprintf(out, "%s: external package, not a target without -n "+
+			"or --stub-missing\n", pkgname)
+	}
+	if names.Len() == 0 {
+		fmt.Fprint(out, "imported by no package\n")
+		return
+	}
+	sort.Sort(&names)
+	fmt.Fprint(out, "imported by:\n")
+	for _, name := range names {
+		importing := StringVector{}
+		for _, fname := range *packages[name].files {
+			if _, _, ok := ImportOffsets(parsed[fname], pkgname); ok {
+				importing.Push(fname)
+			}
+		}
+		fmt.Fprintf(out, "\t%s: %s\n", name, strings.Join(importing, " "))
+	}
+}
+
+// FilePackage returns the name of the package holding the named file.
+func FilePackage(fname string) (string, bool) {
+	for pkgname, pkg := range packages {
+		for _, pfile := range *pkg.files {
+			if path.Clean(pfile) == path.Clean(fname) {
+				return pkgname, true
+			}
+		}
+	}
+	return "", false
+}
+
+// PrintImpact analyzes all go files below the current directory, and prints
+// the packages to be recompiled if the given file changes: its own package,
+// and everything depending on it, directly or not.
+func PrintImpact(args []string) {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, "usage: godep impact FILE\n")
+		os.Exit(1)
+	}
+	Analyze(nil)
+	start, ok := FilePackage(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s is not in any package\n", args[0])
+		os.Exit(1)
+	}
+	// the local packages importing each package
+	importers := map[string]StringVector{}
+	for pkgname, pkg := range packages {
+		for dep := range pkg.packages {
+			if _, ok := packages[dep]; ok {
+				importers[dep] = append(importers[dep], pkgname)
+			}
+		}
+	}
+	affected := map[string]bool{start: true}
+	queue := StringVector{start}
+	for queue.Len() > 0 {
+		pkgname := queue[0]
+		queue = queue[1:]
+		for _, importer := range importers[pkgname] {
+			if !affected[importer] {
+				affected[importer] = true
+				queue.Push(importer)
+			}
+		}
+	}
+	names := StringVector{}
+	for pkgname := range affected {
+		names.Push(pkgname)
+	}
+	sort.Sort(&names)
+	for _, pkgname := range names {
+		fmt.Fprintln(out, pkgname)
+	}
+}
+
+// PrintAdjacencyMatrix prints the import graph as a CSV adjacency matrix,
+// with a header row and column of package names. A cell is 1 if the package
+// of its row imports that of its column.
+func PrintAdjacencyMatrix() {
+	graph := Graph()
+	nodes := SortedNodes(graph)
+	fmt.Fprint(out, "package")
+	for _, node := range nodes {
+		fmt.Fprintf(out, ",%s", node)
+	}
+	fmt.Fprint(out, "\n")
+	for _, row := range nodes {
+		imports := map[string]bool{}
+		for _, dep := range graph[row] {
+			imports[dep] = true
+		}
+		fmt.Fprint(out, row)
+		for _, col := range nodes {
+			if imports[col] {
+				fmt.Fprint(out, ",1")
+			} else {
+				fmt.Fprint(out, ",0")
+			}
+		}
+		fmt.Fprint(out, "\n")
+	}
+}
+
+// PrintStats prints a table of the packages most depended upon, as given by
+// --top, with the number of packages importing each, and the number it
+// imports.
+func PrintStats() {
+	top, err := strconv.Atoi(*statsTop)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	graph := Graph()
+	inDegree := map[string]float64{}
+	for _, deps := range graph {
+		for _, dep := range deps {
+			inDegree[dep]++
+		}
+	}
+	ranked := byScore{SortedNodes(graph), inDegree}
+	sort.Sort(ranked)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprint(w, "PACKAGE\tIN\tOUT\n")
+	for i, node := range ranked.nodes {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", node, int(inDegree[node]),
+			len(graph[node]))
+	}
+	w.Flush()
+}
+
+// PrintGraphMetrics prints, as JSON, the diameter of the import graph, its
+// average clustering coefficient, its degree distributions, and the packages
+// with the highest betweenness centrality.
+func PrintGraphMetrics() {
+	graph := Graph()
+	nodes := SortedNodes(graph)
+	// undirected neighbours, for clustering
+	neighbours := map[string]map[string]bool{}
+	for _, node := range nodes {
+		neighbours[node] = map[string]bool{}
+	}
+	inDegree := map[string]int{}
+	for _, node := range nodes {
+		for _, dep := range graph[node] {
+			inDegree[dep]++
+			neighbours[node][dep] = true
+			neighbours[dep][node] = true
+		}
+	}
+	inDist, outDist := map[string]int{}, map[string]int{}
+	for _, node := range nodes {
+		inDist[strconv.Itoa(inDegree[node])]++
+		outDist[strconv.Itoa(len(graph[node]))]++
+	}
+	// average clustering coefficient
+	clustering := 0.0
+	for _, node := range nodes {
+		k := len(neighbours[node])
+		if k < 2 {
+			continue
+		}
+		links := 0
+		for a := range neighbours[node] {
+			for b := range neighbours[node] {
+				if a < b && neighbours[a][b] {
+					links++
+				}
+			}
+		}
+		clustering += 2 * float64(links) / float64(k*(k-1))
+	}
+	if len(nodes) > 0 {
+		clustering /= float64(len(nodes))
+	}
+	// diameter and betweenness, by Brandes' algorithm
+	diameter := 0
+	betweenness := map[string]float64{}
+	for _, src := range nodes {
+		dist := map[string]int{src: 0}
+		sigma := map[string]float64{src: 1}
+		preds := map[string][]string{}
+		order := []string{}
+		queue := []string{src}
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			order = append(order, v)
+			if dist[v] > diameter {
+				diameter = dist[v]
+			}
+			for _, w := range graph[v] {
+				if _, ok := dist[w]; !ok {
+					dist[w] = dist[v] + 1
+					queue = append(queue, w)
+				}
+				if dist[w] == dist[v]+1 {
+					sigma[w] += sigma[v]
+					preds[w] = append(preds[w], v)
+				}
+			}
+		}
+		delta := map[string]float64{}
+		for i := len(order) - 1; i >= 0; i-- {
+			w := order[i]
+			for _, v := range preds[w] {
+				delta[v] += sigma[v] / sigma[w] * (1 + delta[w])
+			}
+			if w != src {
+				betweenness[w] += delta[w]
+			}
+		}
+	}
+	ranked := byScore{nodes.Copy(), betweenness}
+	sort.Sort(ranked)
+	top := []map[string]interface{}{}
+	for i, node := range ranked.nodes {
+		if i == topBetweenness || betweenness[node] == 0 {
+			break
+		}
+		top = append(top, map[string]interface{}{
+			"package":     node,
+			"betweenness": betweenness[node],
+		})
+	}
+	metrics := map[string]interface{}{
+		"diameter":                       diameter,
+		"average_clustering_coefficient": clustering,
+		"in_degree_distribution":         inDist,
+		"out_degree_distribution":        outDist,
+		"highest_betweenness":            top,
+	}
+	data, err := json.MarshalIndent(metrics, "", "\t")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "%s\n", data)
+}
+
+//
+// Unused imports
+//
+
+// ImportName returns the name by which a file refers to an import.
+func ImportName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	return path.Base(strings.Trim(string(spec.Path.Value), "\""))
+}
+
+// ParsedNames maps the import path of each package parsed, whether by
+// directory, below its module, or by name, as godep itself imports local
+// packages, to the name it declares.
+func ParsedNames() map[string]string {
+	names := map[string]string{}
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	for fname, file := range parsed {
+		dir := path.Dir(path.Clean(fname))
+		if _, ok := names[dir]; ok {
+			continue
+		}
+		names[dir] = file.Name.Name
+		abs := dir
+		if !path.IsAbs(abs) {
+			abs = path.Join(wd, dir)
+		}
+		names[DirImportPath(abs)] = file.Name.Name
+	}
+	// a local package is imported by its name
+	for pkgname := range packages {
+		names[pkgname] = pkgname
+	}
+	return names
+}
+
+// KnownImportName returns the name by which a file refers to an import, if
+// it can be told: given in the import, declared by a package parsed, or else
+// the last element of a standard package's path.
+func KnownImportName(spec *ast.ImportSpec, names map[string]string) (string,
+	bool) {
+	if spec.Name != nil {
+		return spec.Name.Name, true
+	}
+	ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
+	if name, ok := names[ppath]; ok {
+		return name, true
+	}
+	// standard packages are named after the last element of their path
+	if !strings.Contains(strings.Split(ppath, "/", -1)[0], ".") {
+		return path.Base(ppath), true
+	}
+	return "", false
+}
+
+//
+// UseVisitor
+//
+// Records the names of all packages referred to in a file.
+//
+
+type UseVisitor struct {
+	used map[string]bool
+}
+
+func (v UseVisitor) Visit(node ast.Node) ast.Visitor {
+	if sel, ok := node.(*ast.SelectorExpr); ok {
+		if ident, ok := sel.X.(*ast.Ident); ok {
+			v.used[ident.Name] = true
+		}
+	}
+	return v
+}
+
+// PrintUnusedImports prints, as JSON, the imports of each test file which
+// are never used within it. Those whose name cannot be told are skipped.
+func PrintUnusedImports() {
+	known := ParsedNames()
+	unused := []map[string]interface{}{}
+	names := StringVector{}
+	for fname := range parsed {
+		names.Push(fname)
+	}
+	sort.Sort(&names)
+	for _, fname := range names {
+		if !strings.HasSuffix(fname, "_test.go") {
+			continue
+		}
+		file := parsed[fname]
+		v := UseVisitor{map[string]bool{}}
+		ast.Walk(v, file)
+		for _, spec := range file.Imports {
+			name, ok := KnownImportName(spec, known)
+			if !ok || name == "_" || name == "." || v.used[name] {
+				continue
+			}
+			unused = append(unused, map[string]interface{}{
+				"file":   fname,
+				"import": strings.Trim(string(spec.Path.Value), "\""),
+				"line":   fset.Position(spec.Pos()).Line,
+			})
+		}
+	}
+	data, err := json.MarshalIndent(unused, "", "\t")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "%s\n", data)
+}
+
+//
+// Bazel
+//
+
+// BazelLabel returns the label of a dependency in rules_go conventions: a
+// local package is a target in the same file, and an external one lives in
+// a repository named after its root, as gazelle would name it, the root
+// package itself being the target named after its last element. Standard
+// packages have no label.
+func BazelLabel(pkgname string) string {
+	if _, ok := packages[pkgname]; ok {
+		return ":" + pkgname
+	}
+	parts := strings.Split(pkgname, "/", -1)
+	if !strings.Contains(parts[0], ".") || len(parts) < 3 {
+		return ""
+	}
+	// reverse the domain, then append the rest of the root
+	domain := strings.Split(parts[0], ".", -1)
+	repo := StringVector{}
+	for i := len(domain) - 1; i >= 0; i-- {
+		repo.Push(domain[i])
+	}
+	repo.Push(parts[1])
+	repo.Push(parts[2])
+	name := strings.Map(func(c int) int {
+		if c == '-' || c == '.' {
+			return '_'
+		}
+		return c
+	}, strings.Join(repo, "_"))
+	if len(parts) == 3 {
+		return "@" + name + "//:" + parts[2]
+	}
+	return "@" + name + "//" + strings.Join(parts[3:], "/")
+}
+
+// splitTests returns the given files, split into sources and tests.
+func splitTests(fnames []string) (srcs, tests StringVector) {
+	for _, fname := range fnames {
+		if strings.HasSuffix(fname, "_test.go") {
+			tests.Push(fname)
+		} else {
+			srcs.Push(fname)
+		}
+	}
+	return srcs, tests
+}
+
+// writeBazelList writes a list attribute of a bazel rule.
+func writeBazelList(buf *bytes.Buffer, attr string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "    %s = [\n", attr)
+	for _, item := range items {
+		fmt.Fprintf(buf, "        \"%s\",\n", item)
+	}
+	fmt.Fprint(buf, "    ],\n")
+}
+
+// WriteBazelBuild writes a go_library rule for each package, and a go_binary
+// rule for each executable, to the named file.
+func WriteBazelBuild(fname string) {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprint(buf, "# Auto-generated by godep - DO NOT MODIFY\n")
+	fmt.Fprint(buf, "load(\"@io_bazel_rules_go//go:def.bzl\", "+
+		"\"go_binary\", \"go_library\", \"go_test\")\n")
+	for _, pkgname := range SortedNodes(Graph()) {
+		pkg, ok := packages[pkgname]
+		if !ok {
+			continue
+		}
+		deps := StringVector{}
+		for dep := range pkg.packages {
+			if label := BazelLabel(dep); label != "" {
+				deps.Push(label)
+			}
+		}
+		sort.Sort(&deps)
+		srcs, tests := splitTests(*pkg.files)
+		if pkgname != "main" {
+			fmt.Fprint(buf, "\ngo_library(\n")
+			fmt.Fprintf(buf, "    name = \"%s\",\n", pkgname)
+			writeBazelList(buf, "srcs", srcs)
+			fmt.Fprintf(buf, "    importpath = \"%s\",\n", pkgname)
+			writeBazelList(buf, "deps", deps)
+			fmt.Fprint(buf, ")\n")
+		} else {
+			for _, app := range MainApps() {
+				appSrcs, _ := splitTests(app.files)
+				fmt.Fprint(buf, "\ngo_binary(\n")
+				fmt.Fprintf(buf, "    name = \"%s\",\n", path.Base(app.name))
+				writeBazelList(buf, "srcs", appSrcs)
+				writeBazelList(buf, "deps", deps)
+				fmt.Fprint(buf, ")\n")
+			}
+		}
+		if tests.Len() == 0 {
+			continue
+		}
+		fmt.Fprint(buf, "\ngo_test(\n")
+		fmt.Fprintf(buf, "    name = \"%s_test\",\n", pkgname)
+		if pkgname != "main" {
+			writeBazelList(buf, "srcs", tests)
+			writeBazelList(buf, "embed", []string{":" + pkgname})
+		} else {
+			// the tests of the main package are built with its files which
+			// are not application roots
+			for _, fname := range srcs {
+				if _, ok := roots[fname]; !ok {
+					tests.Push(fname)
+				}
+			}
+			sort.Sort(&tests)
+			writeBazelList(buf, "srcs", tests)
+		}
+		writeBazelList(buf, "deps", deps)
+		fmt.Fprint(buf, ")\n")
+	}
+	if err := ioutil.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+//
+// Workspaces
+//
+
+//
+// ModFinder
+//
+// Finds the roots of all modules, by their go.mod files.
+//
+
+type ModFinder struct {
+	roots *StringVector
+}
+
+func (f ModFinder) VisitDir(path string, finfo *os.FileInfo) bool {
+	return true
+}
+
+func (f ModFinder) VisitFile(fpath string, finfo *os.FileInfo) {
+	if path.Base(fpath) == "go.mod" {
+		f.roots.Push(path.Dir(fpath))
+	}
+}
+
+// the go version of a workspace, if no module gives one
+const defaultGoVersion = "1.18"
+
+// WriteGowork writes a go.work file using every module below the current
+// directory. The go version is taken from the first module declaring one.
+func WriteGowork() {
+	roots := StringVector{}
+	filepath.Walk(".", ModFinder{&roots}, nil)
+	sort.Sort(&roots)
+	version := ""
+	for _, root := range roots {
+		content, err := ioutil.ReadFile(path.Join(root, "go.mod"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n", -1) {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "go" && version == "" {
+				version = fields[1]
+			}
+		}
+	}
+	if version == "" {
+		version = defaultGoVersion
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "go %s\n\nuse (\n", version)
+	for _, root := range roots {
+		if root != "." {
+			root = "./" + root
+		}
+		fmt.Fprintf(buf, "\t%s\n", root)
+	}
+	fmt.Fprint(buf, ")\n")
+	if err := ioutil.WriteFile("go.work", buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+//
+// Licenses
+//
+
+// the names under which a module's license may be found
+var licenseFiles = []string{"LICENSE", "LICENSE.txt", "LICENSE.md", "COPYING"}
+
+// the license of the standard library
+const stdLicense = "BSD-3-Clause"
+
+// a phrase identifying a license, with the SPDX id of that license. The
+// first matching entry wins, so more specific phrases come first.
+type licenseMarker struct {
+	phrase, id string
+}
+
+var licenseMarkers = []licenseMarker{
+	{"Apache License", "Apache-2.0"},
+	{"Mozilla Public License Version 2.0", "MPL-2.0"},
+	{"GNU LESSER GENERAL PUBLIC LICENSE", "LGPL-3.0"},
+	{"GNU GENERAL PUBLIC LICENSE\n                       Version 3", "GPL-3.0"},
+	{"GNU GENERAL PUBLIC LICENSE", "GPL-2.0"},
+	{"Permission is hereby granted, free of charge", "MIT"},
+	{"Neither the name", "BSD-3-Clause"},
+	{"Redistribution and use in source and binary forms", "BSD-2-Clause"},
+	{"Permission to use, copy, modify, and/or distribute", "ISC"},
+	{"This is free and unencumbered software", "Unlicense"},
+}
+
+// ModuleCacheDir returns the directory of a module, given as path@version,
+// in the module cache under the first entry of the GOPATH.
+func ModuleCacheDir(module string) string {
+	// upper case letters are escaped as ! and the lower case letter
+	escaped := ""
+	for _, c := range module {
+		if c >= 'A' && c <= 'Z' {
+			escaped += "!" + string(c-'A'+'a')
+		} else {
+			escaped += string(c)
+		}
+	}
+	root := ""
+	if len(Gopath()) > 0 {
+		root = Gopath()[0]
+	}
+	return path.Join(root, "pkg", "mod", escaped)
+}
+
+// ModuleLicense returns the SPDX id of the license of a module, found by the
+// text of its license file, or "unknown".
+func ModuleLicense(module string) string {
+	dir := ModuleCacheDir(module)
+	for _, name := range licenseFiles {
+		content, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		for _, marker := range licenseMarkers {
+			if strings.Contains(string(content), marker.phrase) {
+				return marker.id
+			}
+		}
+	}
+	return "unknown"
+}
+
+// LicenseCheck prints, as JSON, the module and license of each external
+// dependency, and exits with an error if any license is denied by --deny.
+func LicenseCheck() {
+	ReadModules()
+	denied := map[string]bool{}
+	for _, id := range strings.Split(*denyLicenses, ",", -1) {
+		if id = strings.TrimSpace(id); id != "" {
+			denied[id] = true
+		}
+	}
+	report := []map[string]interface{}{}
+	bad := false
+	for _, pkgname := range ExternalPackages() {
+		module, license := ModuleOf(pkgname), "unknown"
+		if module != "" {
+			license = ModuleLicense(module)
+		} else if !strings.Contains(strings.Split(pkgname, "/", -1)[0], ".") {
+			module, license = "std", stdLicense
+		}
+		report = append(report, map[string]interface{}{
+			"package":      pkgname,
+			"module":       module,
+			"license_type": license,
+		})
+		bad = bad || denied[license]
+	}
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "%s\n", data)
+	if bad {
+		os.Exit(1)
+	}
+}
+
+//
+// SQLite export
+//
+
+const graphSchema = `BEGIN;
+CREATE TABLE IF NOT EXISTS packages(name TEXT PRIMARY KEY, has_main INTEGER);
+CREATE TABLE IF NOT EXISTS files(name TEXT, package_name TEXT);
+CREATE TABLE IF NOT EXISTS imports(importing_package TEXT,
+	imported_package TEXT);
+DELETE FROM packages;
+DELETE FROM files;
+DELETE FROM imports;
+`
+
+// sqlQuote quotes a string for use in SQL.
+func sqlQuote(str string) string {
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
+
+// ExportGraph writes the packages, their files and their imports to the
+// SQLite database given by --db, replacing any graph already there. The
+// database is written by the sqlite3 program.
+func ExportGraph() {
+	sql := bytes.NewBufferString(graphSchema)
+	for _, pkgname := range SortedNodes(Graph()) {
+		pkg, ok := packages[pkgname]
+		if !ok {
+			continue
+		}
+		hasMain := 0
+		if pkg.hasMain {
+			hasMain = 1
+		}
+		fmt.Fprintf(sql, "INSERT INTO packages VALUES(%s, %d);\n",
+			sqlQuote(pkgname), hasMain)
+		for _, fname := range *pkg.files {
+			fmt.Fprintf(sql, "INSERT INTO files VALUES(%s, %s);\n",
+				sqlQuote(fname), sqlQuote(pkgname))
+		}
+		for dep := range pkg.packages {
+			fmt.Fprintf(sql, "INSERT INTO imports VALUES(%s, %s);\n",
+				sqlQuote(pkgname), sqlQuote(dep))
+		}
+	}
+	fmt.Fprint(sql, "COMMIT;\n")
+	cmd := exec.Command("sqlite3", *graphDB)
+	cmd.Stdin = sql
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+//
+// Server
+//
+
+// A Request is a single line read by the server.
+type Request struct {
+	Op  string
+	Dir string
+}
+
+type cachedFile struct {
+	mtime int64
+	file  *ast.File
+}
+
+// the syntax trees kept between requests, by absolute file name; only
+// used by the server
+var astCache map[string]cachedFile
+
+// cacheKey returns the absolute name of the file and its modification time.
+func cacheKey(fname string) (string, int64, bool) {
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		return "", 0, false
+	}
+	if !path.IsAbs(fname) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", 0, false
+		}
+		fname = path.Join(wd, fname)
+	}
+	return fname, finfo.Mtime_ns, true
+}
+
+// CachedFile returns the syntax tree kept for the named file, if it has not
+// changed since it was parsed.
+func CachedFile(fname string) (*ast.File, bool) {
+	if astCache == nil {
+		return nil, false
+	}
+	key, mtime, ok := cacheKey(fname)
+	if !ok {
+		return nil, false
+	}
+	cached, ok := astCache[key]
+	if !ok || cached.mtime != mtime {
+		return nil, false
+	}
+	return cached.file, true
+}
+
+// CacheFile keeps the syntax tree of the named file for later requests.
+func CacheFile(fname string, file *ast.File) {
+	if astCache == nil {
+		return
+	}
+	if key, mtime, ok := cacheKey(fname); ok {
+		astCache[key] = cachedFile{mtime, file}
+	}
+}
+
+// ResetAnalysis forgets the results of an earlier Analyze.
+func ResetAnalysis() {
+	files = StringVector{}
+	packages = map[string]Package{}
+	parsed = map[string]*ast.File{}
+	skipped = StringVector{}
+	swigWrappers = map[string]string{}
+	parseErrors = []os.Error{}
+	roots = map[string]string{}
+	hidden = map[string]string{}
+}
+
+// Serve reads one JSON request per line from standard input, and writes one
+// JSON response per line to standard output, until the input ends. Files
+// which have not changed are only parsed once.
+func Serve() {
+	astCache = map[string]cachedFile{}
+	keepParsing = true
+	in := bufio.NewReader(os.Stdin)
+	for {
+		line, err := in.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			data, merr := json.Marshal(Respond(line))
+			if merr != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", merr)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", data)
+		}
+		if err == os.EOF {
+			// the errors have been given in the responses
+			parseErrors = []os.Error{}
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// Respond handles a single request, returning the response.
+func Respond(line string) map[string]interface{} {
+	var req Request
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		return map[string]interface{}{"error": err.String()}
+	}
+	if req.Op != "analyze" {
+		return map[string]interface{}{"error": "unknown op: " + req.Op}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return map[string]interface{}{"error": err.String()}
+	}
+	if req.Dir != "" {
+		if err := os.Chdir(req.Dir); err != nil {
+			return map[string]interface{}{"error": err.String()}
+		}
+		defer os.Chdir(wd)
+	}
+	ResetAnalysis()
+	if err := Analyze(nil); err != nil {
+		return map[string]interface{}{"error": err.String()}
+	}
+	errors := []string{}
+	for _, err := range parseErrors {
+		errors = append(errors, err.String())
+	}
+	return map[string]interface{}{
+		"dir":      req.Dir,
+		"packages": PackageInfo(),
+		"errors":   errors,
+	}
+}
+
+//
+// Install script
+//
+
+// BuildOrder returns the packages of the graph we have the source for, each
+// after everything it imports.
+func BuildOrder(graph map[string][]string) StringVector {
+	order := StringVector{}
+	done := map[string]bool{}
+	var visit func(node string)
+	visit = func(node string) {
+		if done[node] {
+			return
+		}
+		done[node] = true
+		for _, dep := range graph[node] {
+			visit(dep)
+		}
+		if _, ok := packages[node]; ok {
+			order.Push(node)
+		}
+	}
+	for _, node := range SortedNodes(graph) {
+		visit(node)
+	}
+	return order
+}
+
+// shellName turns a package name into a shell function name.
+func shellName(pkgname string) string {
+	return "build_" + strings.Map(func(rune int) int {
+		if rune >= 'a' && rune <= 'z' || rune >= 'A' && rune <= 'Z' ||
+			rune >= '0' && rune <= '9' {
+			return rune
+		}
+		return '_'
+	}, pkgname)
+}
+
+// PrintGoBuild prints a shell script running go build on each package, in
+// dependency order, with the tags given by --tags.
+func PrintGoBuild() {
+	build := "go build"
+	if *buildTags != "" {
+		build += " -tags " + *buildTags
+	}
+	fmt.Fprint(out, "#!/bin/sh\n")
+	FprintAutoNotice(out)
+	fmt.Fprint(out, "set -e\n")
+	for _, pkgname := range BuildOrder(Graph()) {
+		if pkgname != "main" {
+			for _, dir := range PackageDirs(packages[pkgname]) {
+				fmt.Fprintf(out, "%s -o %s.a ./%s\n", build, mkRoot(pkgname),
+					mkPath(dir))
+			}
+			continue
+		}
+		for _, app := range MainApps() {
+			names := StringVector{}
+			for _, fname := range app.files {
+				names.Push(mkPath(fname))
+			}
+			fmt.Fprintf(out, "%s -o %s %s\n", build, app.name,
+				strings.Join(names, " "))
+		}
+	}
+}
+
+const installScriptHeader = `#!/bin/sh
+set -e
+
+: ${O:=%s}
+: ${GC:=${O}g}
+: ${LD:=${O}l}
+: ${CC:=gcc}
+: ${CFLAGS:=}
+: ${GOFLAGS:=}
+export CC CFLAGS
+
+`
+
+// WriteInstallScript writes a shell script building every package in
+// dependency order, for use where make is not available. Each package is
+// built by a function of its own.
+func WriteInstallScript(fname string) {
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	ext := objExt
+	if ext == "${O}" {
+		ext = "6"
+	}
+	fmt.Fprintf(file, installScriptHeader, ext)
+	order := BuildOrder(Graph())
+	for _, pkgname := range order {
+		fmt.Fprintf(file, "%s() {\n", shellName(pkgname))
+		if pkgname != "main" {
+			names := StringVector{}
+			for _, fname := range *packages[pkgname].files {
+				names.Push(mkPath(fname))
+			}
+			obj := mkObj(mkRoot(pkgname))
+			fmt.Fprintf(file, "\t${GC} ${GOFLAGS} -o %s %s\n", obj,
+				strings.Join(names, " "))
+			fmt.Fprintf(file, "\tgopack grc %s.a %s\n", mkRoot(pkgname), obj)
+		} else {
+			for _, app := range MainApps() {
+				names := StringVector{}
+				for _, fname := range app.files {
+					names.Push(mkPath(fname))
+				}
+				obj := mkObj(app.name)
+				fmt.Fprintf(file, "\t${GC} ${GOFLAGS} -o %s %s\n", obj,
+					strings.Join(names, " "))
+				fmt.Fprintf(file, "\t${LD} -o %s %s\n", app.name, obj)
+			}
+		}
+		fmt.Fprint(file, "}\n\n")
+	}
+	for _, pkgname := range order {
+		fmt.Fprintln(file, shellName(pkgname))
+	}
+}
+
+//
+// Clean
+//
+
+// ObjectExts returns the extensions of the object files we may have built:
+// the one given by --arch, or any known one.
+func ObjectExts() map[string]bool {
+	exts := map[string]bool{}
+	if objExt != "${O}" {
+		exts[objExt] = true
+		return exts
+	}
+	for _, char := range archChars {
+		exts[char] = true
+	}
+	return exts
+}
+
+// trimExt returns the file name without its extension.
+func trimExt(fname string) string {
+	return fname[:len(fname)-len(path.Ext(fname))]
+}
+
+// Clean removes object files in the current directory which belong to no
+// known package or executable, such as those of deleted or renamed packages.
+func Clean() {
+	known := map[string]bool{}
+	for pkgname := range packages {
+		for _, target := range PackageTargets(pkgname) {
+			known[trimExt(path.Base(target))] = true
+		}
+		known[path.Base(pkgname)] = true
+	}
+	exts := ObjectExts()
+	infos, err := ioutil.ReadDir(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	for _, finfo := range infos {
+		ext := path.Ext(finfo.Name)
+		if !finfo.IsRegular() || ext == "" || !exts[ext[1:]] {
+			continue
+		}
+		if known[trimExt(finfo.Name)] {
+			continue
+		}
+		fmt.Fprintf(out, "rm %s\n", finfo.Name)
+		if err := os.Remove(finfo.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+//
+// Cycles
+//
+
+// FindCycles returns the cycles among the local packages found by a
+// depth-first search, each as the packages along it.
+func FindCycles() [][]string {
+	graph := Graph()
+	cycles := [][]string{}
+	// packages on the stack, and those done with
+	onStack := map[string]bool{}
+	done := map[string]bool{}
+	stack := []string{}
+	var visit func(node string)
+	visit = func(node string) {
+		onStack[node] = true
+		stack = append(stack, node)
+		for _, dep := range graph[node] {
+			if _, ok := packages[dep]; !ok || done[dep] {
+				continue
+			}
+			if !onStack[dep] {
+				visit(dep)
+				continue
+			}
+			// an import of a package on the stack closes a cycle
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i] == dep {
+					cycles = append(cycles, append([]string{}, stack[i:]...))
+					break
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		onStack[node] = false, false
+		done[node] = true
+	}
+	for _, node := range SortedNodes(graph) {
+		if _, ok := packages[node]; ok && !done[node] {
+			visit(node)
+		}
+	}
+	return cycles
+}
+
+// CheckCycles prints each cycle among the local packages, and exits with an
+// error if there are any. With --fix, each cycle is instead broken by
+// removing the import along it found in the fewest files.
+func CheckCycles() {
+	cycles := FindCycles()
+	for _, cycle := range cycles {
+		fmt.Fprintf(out, "cycle: %s -> %s\n", strings.Join(cycle, " -> "),
+			cycle[0])
+	}
+	if len(cycles) == 0 {
+		return
+	}
+	if !*fixCycles {
+		os.Exit(1)
+	}
+	// the removals, by file, applied once all cycles are broken
+	removals := map[string][]Edit{}
+	for ; len(cycles) > 0; cycles = FindCycles() {
+		cycle := cycles[0]
+		from, to, fewest := "", "", -1
+		for i, pkgname := range cycle {
+			dep := cycle[(i+1)%len(cycle)]
+			if n := packages[pkgname].weights[dep]; fewest < 0 || n < fewest {
+				from, to, fewest = pkgname, dep, n
+			}
+		}
+		packages[from].packages[to] = "", false
+		RemoveImport(from, to, removals)
+	}
+	names := StringVector{}
+	for fname := range removals {
+		names.Push(fname)
+	}
+	sort.Sort(&names)
+	for _, fname := range names {
+		edits := byStart(removals[fname])
+		sort.Sort(edits)
+		if err := EditFile(fname, edits); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// RemoveImport adds to the removals, by file, the edits commenting out the
+// import of ppath in each file of the package.
+func RemoveImport(pkgname, ppath string, removals map[string][]Edit) {
+	for _, fname := range *packages[pkgname].files {
+		start, end, ok := ImportOffsets(parsed[fname], ppath)
+		if !ok {
+			continue
+		}
+		removals[fname] = append(removals[fname], Edit{start, end,
+			fmt.Sprintf("// godep: removed cyclic import %q", ppath)})
+		fmt.Fprintf(out, "removed import of %s from %s\n", ppath, fname)
+	}
+}
+
+// ImportOffsets returns the offsets in the file of the start and end of the
+// import of ppath: the spec within a parenthesized import declaration, or
+// else the whole declaration.
+func ImportOffsets(file *ast.File, ppath string) (int, int, bool) {
+	if file == nil {
+		return 0, 0, false
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ispec := spec.(*ast.ImportSpec)
+			if path.Clean(strings.Trim(string(ispec.Path.Value), "\"")) != ppath {
+				continue
+			}
+			var node ast.Node = ispec
+			if !gen.Lparen.IsValid() {
+				node = gen
+			}
+			start := fset.Position(node.Pos()).Offset
+			end := fset.Position(node.End()).Offset
+			return start, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+//
+// JSON snapshots
+//
+
+// PackageInfo maps each package to its files and its imports, sorted.
+func PackageInfo() map[string]map[string][]string {
+	info := map[string]map[string][]string{}
+	for pkgname, pkg := range packages {
+		imports := StringVector{}
+		for dep := range pkg.packages {
+			imports.Push(dep)
+		}
+		sort.Sort(&imports)
+		info[pkgname] = map[string][]string{
+			"files":   *pkg.files,
+			"imports": imports,
+		}
+	}
+	return info
+}
+
+// PrintJSON prints the packages, with their files and imports, as JSON.
+func PrintJSON() {
+	data, err := json.MarshalIndent(PackageInfo(), "", "\t")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "%s\n", data)
+}
+
+// PrintCoverageMap prints, in JSON, the name of the package of each file,
+// by its absolute path.
+func PrintCoverageMap() {
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	owners := map[string]string{}
+	for pkgname, pkg := range packages {
+		for _, fname := range *pkg.files {
+			if !path.IsAbs(fname) {
+				fname = path.Join(wd, fname)
+			}
+			owners[fname] = pkgname
+		}
+	}
+	data, err := json.MarshalIndent(owners, "", "\t")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "%s\n", data)
+}
+
+// goListSlice formats the words as go list does a slice: space-separated,
+// in brackets.
+func goListSlice(words []string) string {
+	return "[" + strings.Join(words, " ") + "]"
+}
+
+// DirImportPath returns the import path of the package in the directory, as
+// go list gives it: below the module of the nearest go.mod, or else below
+// the GOPATH, or else its absolute path after an underscore.
+func DirImportPath(dir string) string {
+	for root := dir; ; root = path.Dir(root) {
+		module := ReadModulePath(path.Join(root, "go.mod"))
+		if module != "" {
+			return path.Join(module, dir[len(root):])
+		}
+		if root == "/" {
+			break
+		}
+	}
+	for _, entry := range Gopath() {
+		src := path.Join(entry, "src") + "/"
+		if strings.HasPrefix(dir, src) {
+			return dir[len(src):]
+		}
+	}
+	return "_" + dir
+}
+
+// PrintGoList prints a line for the directory of each package, in the format
+// of go list -f '{{.Dir}} {{.ImportPath}} {{.GoFiles}} {{.Imports}}': its
+// absolute path, its import path, and its go files and their imports,
+// sorted, leaving out tests. The lines are sorted by import path.
+func PrintGoList() {
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	lines := map[string]string{}
+	ppaths := StringVector{}
+	for _, pkg := range packages {
+		for _, dir := range PackageDirs(pkg) {
+			gofiles, fnames := StringVector{}, StringVector{}
+			for _, fname := range *pkg.files {
+				if path.Dir(fname) != dir ||
+					strings.HasSuffix(fname, "_test.go") {
+					continue
+				}
+				gofiles.Push(path.Base(fname))
+				fnames.Push(fname)
+			}
+			if gofiles.Len() == 0 {
+				continue
+			}
+			sort.Sort(&gofiles)
+			if !path.IsAbs(dir) {
+				dir = path.Join(wd, dir)
+			}
+			ppath := DirImportPath(path.Clean(dir))
+			if _, ok := lines[ppath]; !ok {
+				ppaths.Push(ppath)
+			}
+			lines[ppath] = fmt.Sprintf("%s %s %s %s\n", dir, ppath,
+				goListSlice(gofiles), goListSlice(FileImports(fnames)))
+		}
+	}
+	sort.Sort(&ppaths)
+	for _, ppath := range ppaths {
+		fmt.Fprint(out, lines[ppath])
+	}
+}
+
+// ReadSnapshot reads the packages from a file written with --json.
+func ReadSnapshot(fname string) map[string]map[string][]string {
+	info := map[string]map[string][]string{}
+	content, err := ioutil.ReadFile(fname)
+	if err == nil {
+		err = json.Unmarshal(content, &info)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fname, err)
+		os.Exit(1)
+	}
+	return info
+}
+
+// setDiff returns the words in a but not in b, sorted.
+func setDiff(a, b []string) StringVector {
+	inB := map[string]bool{}
+	for _, word := range b {
+		inB[word] = true
+	}
+	diff := StringVector{}
+	for _, word := range a {
+		if !inB[word] {
+			diff.Push(word)
+		}
+	}
+	sort.Sort(&diff)
+	return diff
+}
+
+// snapshotExternals returns the imports of the snapshot which are not
+// packages of it.
+func snapshotExternals(info map[string]map[string][]string) []string {
+	external := map[string]bool{}
+	for _, pkg := range info {
+		for _, dep := range pkg["imports"] {
+			if _, ok := info[dep]; !ok {
+				external[dep] = true
+			}
+		}
+	}
+	deps := []string{}
+	for dep := range external {
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// SummarizeChanges compares two files written with --json, and prints the
+// packages added and removed, the changes to the files of each package, and
+// the external dependencies added and removed.
+func SummarizeChanges(args []string) {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, "usage: godep summarize-changes OLD NEW\n")
+		os.Exit(1)
+	}
+	old, cur := ReadSnapshot(args[0]), ReadSnapshot(args[1])
+	oldNames, curNames := []string{}, []string{}
+	for pkgname := range old {
+		oldNames = append(oldNames, pkgname)
+	}
+	for pkgname := range cur {
+		curNames = append(curNames, pkgname)
+	}
+	for _, pkgname := range setDiff(curNames, oldNames) {
+		fmt.Fprintf(out, "package added: %s\n", pkgname)
+	}
+	for _, pkgname := range setDiff(oldNames, curNames) {
+		fmt.Fprintf(out, "package removed: %s\n", pkgname)
+	}
+	names := StringVector(curNames)
+	sort.Sort(&names)
+	for _, pkgname := range names {
+		pkg, ok := old[pkgname]
+		if !ok {
+			continue
+		}
+		for _, fname := range setDiff(cur[pkgname]["files"], pkg["files"]) {
+			fmt.Fprintf(out, "file added to %s: %s\n", pkgname, fname)
+		}
+		for _, fname := range setDiff(pkg["files"], cur[pkgname]["files"]) {
+			fmt.Fprintf(out, "file removed from %s: %s\n", pkgname, fname)
+		}
+	}
+	oldDeps, curDeps := snapshotExternals(old), snapshotExternals(cur)
+	for _, dep := range setDiff(curDeps, oldDeps) {
+		fmt.Fprintf(out, "external dependency added: %s\n", dep)
+	}
+	for _, dep := range setDiff(oldDeps, curDeps) {
+		fmt.Fprintf(out, "external dependency removed: %s\n", dep)
+	}
+}
+
+// snapshotEdges returns the imports of the snapshot, as "pkg -> dep" edges
+// in DOT.
+func snapshotEdges(info map[string]map[string][]string) []string {
+	edges := []string{}
+	for pkgname, pkg := range info {
+		for _, dep := range pkg["imports"] {
+			edges = append(edges, fmt.Sprintf("\"%s\" -> \"%s\"", pkgname,
+				dep))
+		}
+	}
+	return edges
+}
+
+// GraphDiff compares two files written with --json, and prints their
+// dependency graphs, merged, in DOT format: the edges only in the new graph
+// in green, those only in the old in red, and the others in gray.
+func GraphDiff(args []string) {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, "usage: godep graph-diff OLD NEW\n")
+		os.Exit(1)
+	}
+	old, cur := snapshotEdges(ReadSnapshot(args[0])),
+		snapshotEdges(ReadSnapshot(args[1]))
+	colors := map[string]string{}
+	for _, edge := range cur {
+		colors[edge] = "green"
+	}
+	for _, edge := range old {
+		if _, ok := colors[edge]; ok {
+			colors[edge] = "gray"
+		} else {
+			colors[edge] = "red"
+		}
+	}
+	edges := StringVector{}
+	for edge := range colors {
+		edges.Push(edge)
+	}
+	sort.Sort(&edges)
+	fmt.Fprint(out, "digraph godep {\n")
+	for _, edge := range edges {
+		fmt.Fprintf(out, "\t%s [color=%s];\n", edge, colors[edge])
+	}
+	fmt.Fprint(out, "}\n")
+}
+
+//
+// Pinning
+//
+
+const lockFile = "deps.lock"
+
+// a module as described by go list -m -json
+type ModuleInfo struct {
+	Path    string
+	Version string
+}
+
+// Pinned is the version and hash of the module providing a package.
+type Pinned struct {
+	Module  string
+	Version string
+	Hash    string
+}
+
+// ReadSums reads the hash recorded in go.sum for each module, by
+// path@version.
+func ReadSums() map[string]string {
+	sums := map[string]string{}
+	content, err := ioutil.ReadFile("go.sum")
+	if err != nil {
+		return sums
+	}
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && !strings.HasSuffix(fields[1], "/go.mod") {
+			sums[fields[0]+"@"+fields[1]] = fields[2]
+		}
+	}
+	return sums
+}
+
+// ResolvePins returns the module currently providing each external
+// dependency, as reported by go list. Packages not provided by a module
+// required in go.mod, such as those of the standard library, are left out.
+func ResolvePins() map[string]Pinned {
+	ReadModules()
+	sums := ReadSums()
+	pins := map[string]Pinned{}
+	for _, pkgname := range ExternalPackages() {
+		mod := ModuleOf(pkgname)
+		if mod == "" {
+			continue
+		}
+		modpath := mod[:strings.LastIndex(mod, "@")]
+		output := bytes.NewBuffer(nil)
+		cmd := exec.Command("go", "list", "-m", "-json", modpath)
+		cmd.Stdout = output
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		var info ModuleInfo
+		if err == nil {
+			err = json.Unmarshal(output.Bytes(), &info)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", pkgname, err)
+			os.Exit(1)
+		}
+		pins[pkgname] = Pinned{info.Path, info.Version,
+			sums[info.Path+"@"+info.Version]}
+	}
+	return pins
+}
+
+// Pin writes the module version and hash of each external dependency to
+// deps.lock.
+func Pin() {
+	data, err := json.MarshalIndent(ResolvePins(), "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(lockFile, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// VerifyPin checks that each external dependency resolves to the module
+// version and hash in deps.lock, printing those which do not, and exits with
+// an error if any differ.
+func VerifyPin() {
+	locked := map[string]Pinned{}
+	content, err := ioutil.ReadFile(lockFile)
+	if err == nil {
+		err = json.Unmarshal(content, &locked)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	pins := ResolvePins()
+	names := StringVector{}
+	for pkgname := range pins {
+		names.Push(pkgname)
+	}
+	sort.Sort(&names)
+	ok := true
+	for _, pkgname := range names {
+		pin, found := locked[pkgname]
+		cur := pins[pkgname]
+		switch {
+		case !found:
+			fmt.Fprintf(out, "%s: not pinned\n", pkgname)
+		case pin.Module != cur.Module || pin.Version != cur.Version ||
+			pin.Hash != cur.Hash:
+			fmt.Fprintf(out, "%s: pinned to %s@%s, but resolves to %s@%s\n",
+				pkgname, pin.Module, pin.Version, cur.Module, cur.Version)
+		default:
+			continue
+		}
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+//
+// API checks
+//
+
+// InternalSymbols returns the top-level identifiers of each package, by
+// name, which are annotated with //godep:internal.
+func InternalSymbols() map[string]map[string]bool {
+	internal := map[string]map[string]bool{}
+	for pkgname, pkg := range packages {
+		internal[pkgname] = map[string]bool{}
+		for _, fname := range *pkg.files {
+			for _, decl := range parsed[fname].Decls {
+				for _, ident := range InternalIdents(decl) {
+					internal[pkgname][ident.Name] = true
+				}
+			}
+		}
+	}
+	return internal
+}
+
+// InternalIdents returns the identifiers declared by a top-level declaration
+// which are annotated with //godep:internal, on the declaration as a whole
+// or on their own spec.
+func InternalIdents(decl ast.Decl) []*ast.Ident {
+	idents := []*ast.Ident{}
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv == nil && HasAnnotation(decl.Doc, internalNote) {
+			idents = append(idents, decl.Name)
+		}
+	case *ast.GenDecl:
+		all := HasAnnotation(decl.Doc, internalNote)
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.TypeSpec:
+				if all || HasAnnotation(spec.Doc, internalNote) {
+					idents = append(idents, spec.Name)
+				}
+			case *ast.ValueSpec:
+				if all || HasAnnotation(spec.Doc, internalNote) {
+					idents = append(idents, spec.Names...)
+				}
+			}
+		}
+	}
+	return idents
+}
+
+// marks an exported identifier as for use within its own package only
+const internalNote = "//godep:internal"
+
+//
+// APIVisitor
+//
+// Records the uses in a file of unexported identifiers of other local
+// packages, or of those annotated with //godep:internal.
+//
+
+type APIVisitor struct {
+	fname    string
+	imports  map[string]string // import names to paths
+	internal map[string]map[string]bool
+	problems *StringVector
+}
+
+func (v APIVisitor) Visit(node ast.Node) ast.Visitor {
+	sel, ok := node.(*ast.SelectorExpr)
+	if !ok {
+		return v
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return v
+	}
+	ppath, ok := v.imports[ident.Name]
+	if !ok {
+		return v
+	}
+	pos := fset.Position(sel.Pos())
+	switch {
+	case !ast.IsExported(sel.Sel.Name):
+		v.problems.Push(fmt.Sprintf("%s:%d: %s.%s is unexported",
+			pos.Filename, pos.Line, ppath, sel.Sel.Name))
+	case v.internal[ppath][sel.Sel.Name]:
+		v.problems.Push(fmt.Sprintf("%s:%d: %s.%s is internal",
+			pos.Filename, pos.Line, ppath, sel.Sel.Name))
+	}
+	return v
+}
+
+// CheckAPI prints each use of an unexported identifier of another local
+// package, or of an exported one annotated with //godep:internal, and exits
+// with an error if there are any.
+func CheckAPI() {
+	internal := InternalSymbols()
+	problems := StringVector{}
+	names := StringVector{}
+	for fname := range parsed {
+		names.Push(fname)
+	}
+	sort.Sort(&names)
+	for _, fname := range names {
+		file := parsed[fname]
+		imports := map[string]string{}
+		for _, spec := range file.Imports {
+			ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
+			if _, ok := packages[ppath]; ok && ppath != file.Name.Name {
+				imports[ImportName(spec)] = ppath
+			}
+		}
+		if len(imports) > 0 {
+			ast.Walk(APIVisitor{fname, imports, internal, &problems}, file)
+		}
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	if problems.Len() > 0 {
+		os.Exit(1)
+	}
+}
+
+//
+// Naming
+//
+
+// the naming rules, in the order they are checked
+var namingRules = []string{"underscore", "case", "dir", "test"}
+
+// NamingProblems returns what is wrong with the name of the package of the
+// named file, by rule: underscores or upper case letters in the name, a
+// directory named differently, or a test package outside a test file.
+func NamingProblems(fname, name string) map[string]string {
+	problems := map[string]string{}
+	isTest := strings.HasSuffix(fname, "_test.go")
+	base := name
+	if isTest && strings.HasSuffix(base, "_test") {
+		base = base[:len(base)-len("_test")]
+	}
+	if strings.Contains(base, "_") {
+		problems["underscore"] = "contains an underscore"
+	}
+	if base != strings.ToLower(base) {
+		problems["case"] = "is not all lower case"
+	}
+	dir := path.Dir(path.Clean(fname))
+	if dir != "." && base != "main" && path.Base(dir) != base {
+		problems["dir"] = "does not match its directory " + dir
+	}
+	if !isTest && (name == "test" || strings.HasSuffix(name, "_test")) {
+		problems["test"] = "is a test package outside a _test.go file"
+	}
+	return problems
+}
+
+// CheckNaming prints each package name breaking the naming rules not
+// skipped with --naming-skip, at the package clause of the first file found
+// declaring it in each directory, and exits with an error if there are any.
+func CheckNaming() {
+	skip := map[string]bool{}
+	for _, rule := range *namingSkip {
+		skip[rule] = true
+	}
+	names := StringVector{}
+	for fname := range parsed {
+		names.Push(fname)
+	}
+	sort.Sort(&names)
+	reported := map[string]bool{}
+	count := 0
+	for _, fname := range names {
+		file := parsed[fname]
+		name := file.Name.Name
+		problems := NamingProblems(fname, name)
+		for _, rule := range namingRules {
+			problem, ok := problems[rule]
+			key := rule + " " + path.Dir(fname) + " " + name
+			if !ok || skip[rule] || reported[key] {
+				continue
+			}
+			reported[key] = true
+			pos := fset.Position(file.Package)
+			fmt.Fprintf(out, "%s:%d: package %s %s (%s)\n", pos.Filename,
+				pos.Line, name, problem, rule)
+			count++
+		}
+	}
+	if count > 0 {
+		os.Exit(1)
+	}
+}
+
+//
+// Renaming
+//
+
+// an edit replacing the source between two offsets
+type Edit struct {
+	start, end int
+	text       string
+}
+
+// byStart sorts edits by their start
+type byStart []Edit
+
+func (e byStart) Len() int           { return len(e) }
+func (e byStart) Less(i, j int) bool { return e[i].start < e[j].start }
+func (e byStart) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// EditFile applies the edits, given in order and not overlapping, to the
+// named file, keeping the original alongside with a .orig suffix, unless an
+// earlier one is already kept there.
+func EditFile(fname string, edits []Edit) os.Error {
+	src, err := ReadSource(fname)
+	if err != nil {
+		return err
+	}
+	edited := bytes.NewBuffer(nil)
+	last := 0
+	for _, edit := range edits {
+		edited.Write(src[last:edit.start])
+		edited.WriteString(edit.text)
+		last = edit.end
+	}
+	edited.Write(src[last:])
+	// written back in the encoding it was read in
+	content, err := EncodeSource(edited.Bytes())
+	if err != nil {
+		return os.NewError(fname + ": " + err.String())
+	}
+	if _, err = os.Stat(fname + ".orig"); err != nil {
+		if err = CopyFile(fname, fname+".orig"); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(fname, content, 0644)
+}
+
+// Offsets returns the offsets in its file of the start and end of a node.
+func Offsets(node ast.Node) (int, int) {
+	return fset.Position(node.Pos()).Offset, fset.Position(node.End()).Offset
+}
+
+// RenamePackage analyzes all go files below the current directory, and
+// rewrites every import of the old path to the new one, along with the
+// package clause of the package's own files. Where the last element of the
+// path changes, importers keep referring to the package by its old name.
+func RenamePackage(args []string) {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, "usage: godep rename-package OLD NEW\n")
+		os.Exit(1)
+	}
+	Analyze(nil)
+	old, renamed := path.Clean(args[0]), path.Clean(args[1])
+	oldName, newName := path.Base(old), path.Base(renamed)
+	names := StringVector{}
+	for fname := range parsed {
+		names.Push(fname)
+	}
+	sort.Sort(&names)
+	for _, fname := range names {
+		file := parsed[fname]
+		edits := []Edit{}
+		dir := path.Dir(path.Clean(fname))
+		ownFile := file.Name.Name == oldName && (old == oldName ||
+			dir == old || strings.HasSuffix(dir, "/"+old))
+		if ownFile && oldName != newName {
+			start, end := Offsets(file.Name)
+			edits = append(edits, Edit{start, end, newName})
+		}
+		for _, spec := range file.Imports {
+			ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
+			if ppath != old {
+				continue
+			}
+			text := fmt.Sprintf("%q", renamed)
+			if spec.Name == nil && oldName != newName {
+				text = oldName + " " + text
+			}
+			start, end := Offsets(spec.Path)
+			edits = append(edits, Edit{start, end, text})
+		}
+		if len(edits) == 0 {
+			continue
+		}
+		if err := EditFile(fname, edits); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(out, "rewrote %s\n", fname)
+	}
+}
+
+//
+// Watching
+//
+
+// PackageStates describes each package by its files, with the time each was
+// modified, and its imports, so that any change to a package changes its
+// description.
+func PackageStates() map[string]string {
+	graph := Graph()
+	states := map[string]string{}
+	for pkgname, pkg := range packages {
+		state := bytes.NewBuffer(nil)
+		for _, fname := range *pkg.files {
+			mtime := int64(0)
+			if finfo, err := os.Stat(fname); err == nil {
+				mtime = finfo.Mtime_ns
+			}
+			fmt.Fprintf(state, "%s %d\n", fname, mtime)
+		}
+		fmt.Fprintf(state, "%s\n", strings.Join(graph[pkgname], " "))
+		states[pkgname] = state.String()
+	}
+	return states
+}
+
+// ChangedPackages returns the packages added, removed or changed between two
+// sets of states, sorted.
+func ChangedPackages(old, cur map[string]string) StringVector {
+	changed := StringVector{}
+	for pkgname, state := range cur {
+		if prev, ok := old[pkgname]; !ok || prev != state {
+			changed.Push(pkgname)
+		}
+	}
+	for pkgname := range old {
+		if _, ok := cur[pkgname]; !ok {
+			changed.Push(pkgname)
+		}
+	}
+	sort.Sort(&changed)
+	return changed
+}
+
+// Reanalyze analyzes all go files below the current directory afresh,
+// parsing only those changed since, and returns the state of each package,
+// along with any error in the tree.
+func Reanalyze() (map[string]string, os.Error) {
+	ResetAnalysis()
+	err := Analyze(nil)
+	return PackageStates(), err
+}
+
+// RewriteMakefile prints the Makefile again: to a fresh all.mk with
+// --output-dir, or else to the output.
+func RewriteMakefile() {
+	if *outputDir == "" {
+		PrintMakefile()
+		return
+	}
+	file := CreateOutput(path.Join(*outputDir, "all.mk"))
+	defer file.Close()
+	out = file
+	PrintMakefile()
+	out = os.Stdout
+}
+
+// Watch analyzes all go files below the current directory whenever any
+// package changes, once the changes have settled for --watch-delay, and
+// prints the Makefile again, or, with --exec, runs the command given with
+// the changed packages as arguments.
+func Watch(args []string) {
+	delay, err := strconv.Atoi(*watchDelay)
+	if err != nil || delay < 1 {
+		fmt.Fprintf(os.Stderr, "invalid --watch-delay: %s\n", *watchDelay)
+		os.Exit(1)
+	}
+	pause := int64(delay) * 1e6
+	// files may be caught half written
+	keepParsing = true
+	astCache = map[string]cachedFile{}
+	states, _ := Reanalyze()
+	for {
+		time.Sleep(pause)
+		cur, err := Reanalyze()
+		if ChangedPackages(states, cur).Len() == 0 {
+			continue
+		}
+		for {
+			time.Sleep(pause)
+			next, nextErr := Reanalyze()
+			settled := ChangedPackages(cur, next).Len() == 0
+			cur, err = next, nextErr
+			if settled {
+				break
+			}
+		}
+		changed := ChangedPackages(states, cur)
+		states = cur
+		// nothing is rebuilt until the tree is fixed
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			continue
+		}
+		if *watchExec == "" {
+			RewriteMakefile()
+			continue
+		}
+		shellArgs := append([]string{"-c", *watchExec + ` "$@"`, "sh"},
+			changed...)
+		cmd := exec.Command("sh", shellArgs...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *watchExec, err)
+		}
+	}
+}
+
+//
+// Protocol buffers
+//
+// The graph is encoded by hand, as a Graph message of doc/godep.proto.
+//
+
+// the wire types used
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+// protoKey appends the key of a field to buf.
+func protoKey(buf *bytes.Buffer, field, wireType int) {
+	protoUvarint(buf, uint64(field<<3|wireType))
+}
+
+// protoUvarint appends a varint to buf.
+func protoUvarint(buf *bytes.Buffer, x uint64) {
+	for x >= 0x80 {
+		buf.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	buf.WriteByte(byte(x))
+}
+
+// protoInt appends a varint field to buf.
+func protoInt(buf *bytes.Buffer, field int, x uint64) {
+	protoKey(buf, field, protoVarint)
+	protoUvarint(buf, x)
+}
+
+// protoMessage appends a string or embedded message field to buf.
+func protoMessage(buf *bytes.Buffer, field int, data []byte) {
+	protoKey(buf, field, protoBytes)
+	protoUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+// WriteProto writes the packages, each with its files and imports, to the
+// named file, as a Graph message.
+func WriteProto(fname string) {
+	deps := Graph()
+	graph := bytes.NewBuffer(nil)
+	for _, pkgname := range SortedNodes(deps) {
+		pkg, ok := packages[pkgname]
+		if !ok {
+			continue
+		}
+		msg := bytes.NewBuffer(nil)
+		protoMessage(msg, 1, []byte(pkgname))
+		if pkg.hasMain {
+			protoInt(msg, 2, 1)
+		}
+		for _, name := range *pkg.files {
+			file := bytes.NewBuffer(nil)
+			protoMessage(file, 1, []byte(name))
+			protoMessage(msg, 3, file.Bytes())
+		}
+		for _, dep := range deps[pkgname] {
+			imp := bytes.NewBuffer(nil)
+			protoMessage(imp, 1, []byte(dep))
+			protoInt(imp, 2, uint64(pkg.weights[dep]))
+			protoMessage(msg, 4, imp.Bytes())
+		}
+		protoMessage(graph, 1, msg.Bytes())
+	}
+	if err := ioutil.WriteFile(fname, graph.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 }
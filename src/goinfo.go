@@ -5,6 +5,7 @@
 package main
 
 import (
+	. "container/vector"
 	"fmt"
 	"go/ast"
 	"go/parser"
@@ -13,6 +14,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -20,6 +23,16 @@ var progName = "goinfo"
 
 var showVersion = opts.LongFlag("version", "display version information")
 var srcRoot = opts.Half("r", "root", "root directory of the source", "", "src")
+var noMain = opts.LongFlag("no-main", "ignore the main package")
+var emitFormat = opts.LongFlag("emit-format",
+	"display a target checking formatting")
+var formatWidth = opts.LongSingle("format-width",
+	"column to wrap long lists at", "80")
+var sortBy = opts.LongSingle("sort-by",
+	"order of files and packages: name, size, deps or depth", "")
+var fileListFormat = opts.LongSingle("file-list-format",
+	"how to list GOFILES: make-variable, wildcard or explicit",
+	"make-variable")
 
 // prefix the root
 func mkRoot(str string) string {
@@ -33,6 +46,21 @@ func main() {
 		ShowVersion()
 		os.Exit(0)
 	}
+	if *sortBy != "" && !sortCriteria[*sortBy] {
+		fmt.Fprintf(os.Stderr, "unknown sort criterion: %s\n", *sortBy)
+		os.Exit(1)
+	}
+	if _, ok := fileListFormats[*fileListFormat]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown file list format: %s\n",
+			*fileListFormat)
+		os.Exit(1)
+	}
+	var err os.Error
+	width, err = strconv.Atoi(*formatWidth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 	// if there are no files, generate a list
 	if len(opts.Args) == 0 {
 		filepath.Walk(".", GoFileFinder{}, nil)
@@ -42,33 +70,183 @@ func main() {
 		}
 	}
 	GetPackageList()
+	AddSwigWrappers()
+	if *sortBy != "" {
+		SortFiles()
+	}
 	PrintAutoNotice()
 	PrintFList()
 	PrintPList()
 	fmt.Println("GOPACKAGES = ${GOPKGS:=.${O}}")
 	fmt.Println("GOARCHIVES = ${GOPKGS:=.a}")
+	if *emitFormat {
+		PrintFormat()
+	}
 }
 
-// Print list of files
-func PrintFList() {
-	fmt.Printf("GOFILES = ")
+// Print a target checking that the files are formatted; gorules prints the
+// format target formatting them
+func PrintFormat() {
+	fmt.Print("format-check: ${GOFILES}\n")
+	fmt.Print("\t@test -z \"$$(gofmt -l ${GOFILES})\" || " +
+		"(gofmt -l ${GOFILES}; exit 1)\n")
+}
+
+// Add the go files which SWIG generates alongside the sources
+func AddSwigWrappers() {
+	known := map[string]bool{}
+	seen := map[string]bool{}
+	dirs := StringVector{}
 	for _, fname := range files {
-		fmt.Print(fname + " ")
+		known[fname] = true
+		if dir := path.Dir(fname); !seen[dir] {
+			dirs.Push(dir)
+			seen[dir] = true
+		}
+	}
+	for _, dir := range dirs {
+		for _, iface := range SwigInterfaces(dir) {
+			if wrapper := SwigWrapper(iface); !known[wrapper] {
+				files.Push(wrapper)
+			}
+		}
+	}
+}
+
+// the column to wrap lists at
+var width int
+
+// the width of the indentation of continued lines
+const tabWidth = 8
+
+// Print a variable holding a list, continuing it on further lines so that
+// none is longer than the --format-width
+func PrintList(name string, words []string) {
+	fmt.Printf("%s =", name)
+	col := len(name) + 2
+	for i, word := range words {
+		// leave room for the continuation
+		if i > 0 && col+1+len(word)+2 > width {
+			fmt.Printf(" \\\n\t%s", word)
+			col = tabWidth + len(word)
+			continue
+		}
+		fmt.Printf(" %s", word)
+		col += 1 + len(word)
 	}
 	fmt.Print("\n")
 }
 
+// the ways of listing the files, by --file-list-format
+var fileListFormats = map[string]func(){
+	"make-variable": func() { PrintList("GOFILES", files) },
+	"wildcard":      PrintWildcardFList,
+	"explicit":      PrintExplicitFList,
+}
+
+// Print list of files, as given by --file-list-format
+func PrintFList() {
+	fileListFormats[*fileListFormat]()
+}
+
+// Print list of files as a wildcard matching the go files in each of their
+// directories
+func PrintWildcardFList() {
+	patterns := StringVector{}
+	seen := map[string]bool{}
+	for _, fname := range files {
+		if dir := path.Dir(fname); !seen[dir] {
+			patterns.Push(path.Join(dir, "*.go"))
+			seen[dir] = true
+		}
+	}
+	fmt.Printf("GOFILES := $(wildcard %s)\n", strings.Join(patterns, " "))
+}
+
+// Print list of files one per line, so that each may be commented out
+func PrintExplicitFList() {
+	fmt.Print("GOFILES =\n")
+	for _, fname := range files {
+		fmt.Printf("GOFILES += %s\n", fname)
+	}
+}
+
 var packages = map[string]*struct{}{}
 
+// the package each file belongs to, and the imports of each package
+var filePackages = map[string]string{}
+var imports = map[string]map[string]bool{}
+
+// Record a file of the package, along with its imports
+func AddPackage(pname, fname string, file *ast.File) {
+	packages[pname] = nil
+	filePackages[fname] = pname
+	if _, ok := imports[pname]; !ok {
+		imports[pname] = map[string]bool{}
+	}
+	for _, spec := range file.Imports {
+		ppath := path.Clean(strings.Trim(string(spec.Path.Value), "\""))
+		imports[pname][ppath] = true
+	}
+}
+
+// the packages in the order given by --sort-by
+var sorted StringVector
+
+// Sort the packages as given by --sort-by, and the files by package, then by
+// name
+func SortFiles() {
+	graph := map[string][]string{}
+	sizes := map[string]int{}
+	for pname := range packages {
+		deps := []string{}
+		for dep := range imports[pname] {
+			deps = append(deps, dep)
+		}
+		graph[pname] = deps
+	}
+	for _, pname := range filePackages {
+		sizes[pname]++
+	}
+	sorted = StringVector{}
+	rank := map[string]int{}
+	for _, pname := range SortPackages(*sortBy, graph, sizes) {
+		if _, ok := packages[pname]; ok {
+			rank[pname] = sorted.Len()
+			sorted.Push(pname)
+		}
+	}
+	// files of no known package, such as SWIG wrappers, come last
+	byPackage := make([]StringVector, sorted.Len()+1)
+	sort.Sort(&files)
+	for _, fname := range files {
+		i := sorted.Len()
+		if pname, ok := filePackages[fname]; ok {
+			i = rank[pname]
+		}
+		byPackage[i].Push(fname)
+	}
+	files = StringVector{}
+	for _, fnames := range byPackage {
+		files.AppendVector(&fnames)
+	}
+}
+
 func GetPackageList() {
+	// the files not in an ignored package
+	kept := StringVector{}
 	for _, fname := range files {
 		fset := token.NewFileSet()
-		file, err := parser.ParseFile(fset, fname, nil, parser.PackageClauseOnly)
+		file, err := parser.ParseFile(fset, fname, nil, parser.ImportsOnly)
 		if err != nil {
 			fmt.Fprint(os.Stderr, err)
 			os.Exit(1)
 		}
 		pname := file.Name.Name
+		if pname == "main" && *noMain {
+			continue
+		}
+		kept.Push(fname)
 		if pname == "main" {
 			fset := token.NewFileSet()
 			fullfile, err := parser.ParseFile(fset, fname, nil, 0)
@@ -79,36 +257,29 @@ func GetPackageList() {
 					// get the name from the filename
 					fparts := strings.Split(fname, ".", -1)
 					basename := path.Base(fparts[0])
-					packages[basename] = nil
+					AddPackage(basename, fname, file)
 				} else {
-					packages[pname] = nil
+					AddPackage(pname, fname, file)
 				}
 			}
 		} else {
-			packages[file.Name.Name] = nil
+			AddPackage(pname, fname, file)
 		}
 	}
-}
-
-type MainCheckVisitor struct {
-	fname   string
-	hasMain bool
-}
-
-func (v *MainCheckVisitor) Visit(node ast.Node) ast.Visitor {
-	if decl, ok := node.(*ast.FuncDecl); ok {
-		if decl.Name.Name == "main" {
-			v.hasMain = true
-		}
-	}
-	return v
+	files = kept
 }
 
 // Print list of packages
 func PrintPList() {
-	fmt.Print("GOPKGS = ")
-	for pname := range packages {
-		fmt.Printf("%s ", mkRoot(pname))
+	pnames := StringVector{}
+	if sorted != nil {
+		for _, pname := range sorted {
+			pnames.Push(mkRoot(pname))
+		}
+	} else {
+		for pname := range packages {
+			pnames.Push(mkRoot(pname))
+		}
 	}
-	fmt.Print("\n")
+	PrintList("GOPKGS", pnames)
 }
@@ -5,9 +5,17 @@
 package main
 
 import (
+	. "container/vector"
 	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
 	"opts"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 var progName = "gorules"
@@ -15,6 +23,26 @@ var progName = "gorules"
 var showVersion = opts.LongFlag("version", "display version information")
 var mainExecName = opts.Single("x", "execname",
 	"name to use for executable made from 'main.go'", "main")
+var fragment = opts.Single("f", "fragment",
+	"dependency fragment generated by godep", "Makefile.deps")
+var showSums = opts.LongFlag("go-sum",
+	"display the go.sum entries of external dependencies")
+var crossCompile = opts.LongSingle("cross-compile",
+	"GOOS/GOARCH to compile for", "")
+var preBuild = opts.LongMulti("pre-build",
+	"command to run before each compilation", "")
+var postBuild = opts.LongMulti("post-build",
+	"command to run after each compilation", "")
+var dockerBase = opts.LongSingle("dockerfile",
+	"base image of a Dockerfile to also write", "")
+var vendorRules = opts.LongFlag("vendor-rules",
+	"display rules building the packages in vendor/")
+var moduleMode = opts.LongFlag("module-mode",
+	"display rules building the module in go.mod with go build")
+var testBinaries = opts.LongFlag("test-binaries",
+	"display rules building the test binary of each package")
+var testSuffix = opts.LongSingle("test-binary-suffix",
+	"suffix of the names of test binaries", ".test")
 
 func main() {
 	// parse and handle options
@@ -23,16 +51,448 @@ func main() {
 		ShowVersion()
 		os.Exit(0)
 	}
+	if len(opts.Args) > 0 {
+		switch opts.Args[0] {
+		case "install-hooks":
+			InstallHooks()
+		case "remove-hooks":
+			RemoveHooks()
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", opts.Args[0])
+			os.Exit(1)
+		}
+		return
+	}
 	PrintAutoNotice()
-	fmt.Print(
+	if *crossCompile != "" {
+		PrintCrossCompile()
+	}
+	pre, post := HookLines(*preBuild), HookLines(*postBuild)
+	if *moduleMode {
+		PrintModuleRules(pre, post)
+	} else {
+		PrintSuffixRules(pre, post)
+	}
+	if *showSums {
+		PrintSums()
+	}
+	if *dockerBase != "" {
+		WriteDockerfile()
+	}
+	if *vendorRules {
+		PrintVendorRules()
+	}
+	if *testBinaries {
+		PrintTestBinaries(pre, post)
+	}
+}
+
+// PrintTestBinaries prints a rule building the test binary of each package
+// with tests, with the given hook lines around it. Each is named after the
+// package, or, where packages in several directories share a name, after
+// its directory, with the --test-binary-suffix.
+func PrintTestBinaries(pre, post string) {
+	// the files may already have been found for --cross-compile
+	if files.Len() == 0 {
+		filepath.Walk(".", GoFileFinder{}, nil)
+	}
+	dirs := StringVector{}
+	// the files in each directory, and the name of its package
+	dirFiles := map[string]*StringVector{}
+	names := map[string]string{}
+	for _, fname := range files {
+		dir := path.Dir(fname)
+		if _, ok := dirFiles[dir]; !ok {
+			dirs.Push(dir)
+			dirFiles[dir] = &StringVector{}
+		}
+		dirFiles[dir].Push(fname)
+		if !strings.HasSuffix(fname, "_test.go") || names[dir] != "" {
+			continue
+		}
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, fname, nil, parser.PackageClauseOnly)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		name := file.Name.Name
+		if strings.HasSuffix(name, "_test") {
+			name = name[:len(name)-len("_test")]
+		}
+		names[dir] = name
+	}
+	// the number of directories with each package name
+	shared := map[string]int{}
+	for _, name := range names {
+		shared[name]++
+	}
+	sort.Sort(&dirs)
+	for _, dir := range dirs {
+		name, ok := names[dir]
+		if !ok {
+			continue
+		}
+		if shared[name] > 1 && dir != "." {
+			name = strings.Replace(dir, "/", "_", -1)
+		}
+		fmt.Printf("\n%s%s: %s\n", name, *testSuffix,
+			strings.Join(*dirFiles[dir], " "))
+		fmt.Printf("%s        go test -c -o $@ ./%s\n%s", pre, dir, post)
+	}
+}
+
+// PrintSuffixRules prints the rules compiling go files into objects and
+// archives, with the given hook lines around each compilation.
+func PrintSuffixRules(pre, post string) {
+	fmt.Printf(
 `
 .go.${O}:
-        ${GC} $*.go
-
+%s        ${GC} $*.go
+%s
 .go.a:
-        ${GC} -o $*.${O} $*.go && gopack grc $*.a $*.${O}
+%s        ${GC} -o $*.${O} $*.go && gopack grc $*.a $*.${O}
+%s
+format:
+        gofmt -w ${GOFILES}
+`, pre, post, pre, post)
+}
+
+// the rules building a module, by its path, with the go tool
+const moduleRules = `
+MODULE = %s
+TARG = %s
+
+${TARG}: ${GOFILES}
+%s        go build -mod=mod -o ${TARG} .
+%s
+tidy:
+        go mod tidy
 
 format:
         gofmt -w ${GOFILES}
-`)
+`
+
+// ModulePath returns the path of the module declared in go.mod.
+func ModulePath() string {
+	if _, err := os.Stat("go.mod"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	module := ReadModulePath("go.mod")
+	if module == "" {
+		fmt.Fprint(os.Stderr, "go.mod declares no module\n")
+		os.Exit(1)
+	}
+	return module
+}
+
+// PrintModuleRules prints rules building the module in go.mod with go
+// build, into an executable named after the module, and tidying it.
+func PrintModuleRules(pre, post string) {
+	module := ModulePath()
+	fmt.Printf(moduleRules, module, path.Base(module), pre, post)
+}
+
+// the stages of the Dockerfile: binaries are built with the official go
+// image, then copied into the given base image
+const dockerBuild = `# Auto-generated - DO NOT MODIFY
+FROM golang AS build
+WORKDIR /src
+COPY go.mod go.sum* ./
+RUN go mod download
+COPY . .
+`
+
+const dockerFinal = `
+FROM %s
+COPY --from=build /out/ /usr/local/bin/
+`
+
+// WriteDockerfile writes a multi-stage Dockerfile building every executable
+// below the current directory.
+func WriteDockerfile() {
+	// the files may already have been found for --cross-compile
+	if files.Len() == 0 {
+		filepath.Walk(".", GoFileFinder{}, nil)
+	}
+	// the sources of each executable, by name: a subdirectory, or, in the
+	// current directory, each file with a main function along with the
+	// other files of package main
+	sources := map[string]string{}
+	roots, common := StringVector{}, StringVector{}
+	for _, fname := range files {
+		inMain, hasMain := MainFile(fname)
+		dir := path.Dir(fname)
+		switch {
+		case !inMain:
+		case dir != ".":
+			if hasMain {
+				sources[path.Base(dir)] = "./" + dir
+			}
+		case hasMain:
+			roots.Push(fname)
+		default:
+			common.Push(fname)
+		}
+	}
+	for _, fname := range roots {
+		base := path.Base(fname)
+		sources[base[:len(base)-len(".go")]] =
+			strings.Join(append([]string{fname}, common...), " ")
+	}
+	names := StringVector{}
+	for name := range sources {
+		names.Push(name)
+	}
+	sort.Sort(&names)
+	dockerfile := dockerBuild
+	for _, name := range names {
+		dockerfile += fmt.Sprintf("RUN go build -o /out/%s %s\n", name,
+			sources[name])
+	}
+	dockerfile += fmt.Sprintf(dockerFinal, *dockerBase)
+	err := ioutil.WriteFile("Dockerfile", []byte(dockerfile), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// HookLines returns the recipe lines running the given hook commands, in
+// order.
+func HookLines(hooks []string) string {
+	lines := ""
+	for _, hook := range hooks {
+		lines += "        " + hook + "\n"
+	}
+	return lines
+}
+
+// ReadExternal reads the external dependencies listed in the fragment.
+func ReadExternal() []string {
+	content, err := ioutil.ReadFile(*fragment)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	const prefix = "# external packages:"
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		if strings.HasPrefix(line, prefix) {
+			return strings.Fields(line[len(prefix):])
+		}
+	}
+	return nil
+}
+
+// PrintSums prints, as comments, the module version and hash recorded in
+// go.sum for each external dependency listed in the fragment.
+func PrintSums() {
+	content, err := ioutil.ReadFile("go.sum")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	// module path => "version hash"
+	sums := map[string]string{}
+	for _, line := range strings.Split(string(content), "\n", -1) {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]] = fields[1] + " " + fields[2]
+	}
+	fmt.Print("\n")
+	for _, pkg := range ReadExternal() {
+		// the longest module path containing the package
+		module := ""
+		for mod := range sums {
+			if (pkg == mod || strings.HasPrefix(pkg, mod+"/")) &&
+				len(mod) > len(module) {
+				module = mod
+			}
+		}
+		if module != "" {
+			fmt.Printf("# %s: %s@%s\n", pkg, module, sums[module])
+		}
+	}
+}
+
+const hookPath = ".git/hooks/pre-commit"
+
+// the original hook, if any, is kept here and run by ours
+const origHookPath = ".git/hooks/pre-commit.orig"
+
+// marks a hook as one of ours
+const hookMarker = "# installed by gorules install-hooks"
+
+// the hook script; aborts the commit if the fragment is stale, running the
+// command line recorded in it again with --verify
+const hookScript = `#!/bin/sh
+%s
+orig=%s
+fragment=%s
+if [ -x "$orig" ]; then
+	"$orig" "$@" || exit 1
+fi
+command=$(sed -n 's/^# Generated with: //p' "$fragment")
+eval "${command:-godep} --verify=\"\$fragment\"" || exit 1
+`
+
+// isOurHook reports whether the file at fname was written by InstallHooks.
+func isOurHook(fname string) bool {
+	content, err := ioutil.ReadFile(fname)
+	return err == nil && strings.Contains(string(content), hookMarker)
+}
+
+// InstallHooks writes a pre-commit hook checking that the dependency
+// fragment is up to date. An existing hook of our own is replaced; any other
+// hook is kept and run first, unless a hook is kept already.
+func InstallHooks() {
+	if _, err := os.Stat(hookPath); err == nil && !isOurHook(hookPath) {
+		if _, err := os.Stat(origHookPath); err == nil {
+			fmt.Fprintf(os.Stderr, "%s already exists; not replacing %s\n",
+				origHookPath, hookPath)
+			os.Exit(1)
+		}
+		if err := os.Rename(hookPath, origHookPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+	script := fmt.Sprintf(hookScript, hookMarker, ShellQuote(origHookPath),
+		ShellQuote(*fragment))
+	if err := ioutil.WriteFile(hookPath, []byte(script), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// RemoveHooks undoes InstallHooks, restoring any hook it wrapped.
+func RemoveHooks() {
+	if !isOurHook(hookPath) {
+		fmt.Fprintf(os.Stderr, "%s was not installed by gorules\n", hookPath)
+		os.Exit(1)
+	}
+	if err := os.Remove(hookPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if _, err := os.Stat(origHookPath); err == nil {
+		if err := os.Rename(origHookPath, hookPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// PrintCrossCompile sets the target, and the compiler and linker for it,
+// and lists the go files built for it.
+func PrintCrossCompile() {
+	target := strings.Split(*crossCompile, "/", -1)
+	if len(target) != 2 || !knownOS[target[0]] ||
+		archChars[target[1]] == "" {
+		fmt.Fprintf(os.Stderr, "invalid target: %s\n", *crossCompile)
+		os.Exit(1)
+	}
+	targetOS, targetArch = target[0], target[1]
+	char := archChars[targetArch]
+	fmt.Printf("GOOS = %s\n", targetOS)
+	fmt.Printf("GOARCH = %s\n", targetArch)
+	fmt.Printf("O = %s\n", char)
+	fmt.Printf("GC = %sg\n", char)
+	fmt.Printf("LD = %sl\n", char)
+	filepath.Walk(".", GoFileFinder{}, nil)
+	fmt.Print("GOFILES = ")
+	for _, fname := range files {
+		fmt.Printf("%s ", fname)
+	}
+	fmt.Print("\n")
+}
+
+const vendorDir = "vendor"
+
+// VendorFinder collects the go files, other than tests, of each directory
+// below vendor/.
+type VendorFinder map[string]*StringVector
+
+func (f VendorFinder) VisitDir(path string, finfo *os.FileInfo) bool {
+	return true
+}
+
+func (f VendorFinder) VisitFile(fpath string, finfo *os.FileInfo) {
+	if path.Ext(fpath) != ".go" || strings.HasSuffix(fpath, "_test.go") ||
+		!MatchesTarget(fpath) {
+		return
+	}
+	dir := path.Dir(fpath)
+	if _, ok := f[dir]; !ok {
+		f[dir] = &StringVector{}
+	}
+	f[dir].Push(fpath)
+}
+
+// PrintVendorRules prints a rule building each package in vendor/, along
+// with a vendor-build target building all of them, in dependency order.
+func PrintVendorRules() {
+	found := VendorFinder{}
+	filepath.Walk(vendorDir, found, nil)
+	dirs := StringVector{}
+	// the vendored packages imported by each
+	deps := map[string]*StringVector{}
+	for dir, fnames := range found {
+		dirs.Push(dir)
+		deps[dir] = &StringVector{}
+		seen := map[string]bool{}
+		for _, fname := range *fnames {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, fname, nil, parser.ImportsOnly)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			for _, spec := range file.Imports {
+				ipath := strings.Trim(string(spec.Path.Value), "\"")
+				dep := path.Join(vendorDir, ipath)
+				if _, ok := found[dep]; ok && !seen[dep] {
+					deps[dir].Push(dep)
+					seen[dep] = true
+				}
+			}
+		}
+	}
+	sort.Sort(&dirs)
+	// order the packages after those they import
+	order := StringVector{}
+	done := map[string]bool{}
+	var visit func(dir string)
+	visit = func(dir string) {
+		if done[dir] {
+			return
+		}
+		done[dir] = true
+		for _, dep := range *deps[dir] {
+			visit(dep)
+		}
+		order.Push(dir)
+	}
+	for _, dir := range dirs {
+		visit(dir)
+	}
+	fmt.Print("\n")
+	for _, dir := range order {
+		fmt.Printf("%s.a: %s", dir, strings.Join(*found[dir], " "))
+		for _, dep := range *deps[dir] {
+			fmt.Printf(" %s.a", dep)
+		}
+		fmt.Print("\n")
+		fmt.Printf("        ${GC} -I %s -o %s.${O} %s", vendorDir, dir,
+			strings.Join(*found[dir], " "))
+		fmt.Printf(" && gopack grc %s.a %s.${O}\n", dir, dir)
+	}
+	fmt.Print("vendor-build:")
+	for _, dir := range order {
+		fmt.Printf(" %s.a", dir)
+	}
+	fmt.Print("\n")
 }